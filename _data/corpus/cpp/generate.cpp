@@ -0,0 +1,64 @@
+// Writes the 64-bit fixtures described in ../../README.md with CRoaring's Roaring64Map::write in the portable format.
+// Build it against the CRoaring v4.2.1 amalgamation (roaring.c, roaring.h and roaring.hh from the release)
+// and run it from this directory:
+//
+//   c++ -std=c++11 -O2 -I. generate.cpp roaring.c -o generate && ./generate
+#include <cstdint>
+#include <cstdio>
+#include <string>
+#include <vector>
+
+#include "roaring.hh"
+
+using roaring::Roaring64Map;
+
+struct Span {
+  uint64_t first, last, step;
+};
+
+struct Fixture {
+  const char *name;
+  std::vector<Span> spans;
+  bool runOptimize;
+};
+
+// keep in sync with ../java/Generate.java, the manifest entries of these files list the same spans
+static const uint64_t top = uint64_t(1) << 63;
+static const uint64_t keyStep = (uint64_t(1) << 32) + 1;
+
+static const std::vector<Fixture> fixtures = {
+    {"empty", {}, false},
+    {"single", {{42, 42, 1}}, false},
+    {"maxuint64", {{UINT64_MAX, UINT64_MAX, 1}}, false},
+    {"dense", {{uint64_t(1) << 32, (uint64_t(1) << 32) + 131070, 2}}, false},
+    {"runs", {{0, 99999, 1}, {uint64_t(1) << 33, (uint64_t(1) << 33) + 4999999, 1}, {top, top + 99999, 1}}, true},
+    {"manykeys", {{0, 999 * keyStep, keyStep}, {top, top + 999 * keyStep, keyStep}}, false},
+};
+
+int main() {
+  std::printf("CRoaring %d.%d.%d\n", ROARING_VERSION_MAJOR, ROARING_VERSION_MINOR, ROARING_VERSION_REVISION);
+  for (const Fixture &f : fixtures) {
+    Roaring64Map rb;
+    for (const Span &s : f.spans) {
+      for (uint64_t v = s.first;; v += s.step) {
+        rb.add(v);
+        if (s.last - v < s.step) {
+          break;
+        }
+      }
+    }
+    if (f.runOptimize) {
+      rb.runOptimize();
+    }
+
+    std::vector<char> buf(rb.getSizeInBytes(true));
+    size_t n = rb.write(buf.data(), true);
+    std::string name = std::string(f.name) + ".bin";
+    FILE *out = std::fopen(name.c_str(), "wb");
+    if (out == nullptr || std::fwrite(buf.data(), 1, n, out) != n || std::fclose(out) != 0) {
+      std::perror(name.c_str());
+      return 1;
+    }
+  }
+  return 0;
+}
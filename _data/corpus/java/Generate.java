@@ -0,0 +1,79 @@
+// Writes the Java fixtures described in ../../README.md with RoaringBitmap 1.3.0 on the classpath
+// (org.roaringbitmap:RoaringBitmap:1.3.0 from Maven Central), run from this directory:
+//
+//   javac -cp RoaringBitmap.jar Generate.java && java -cp RoaringBitmap.jar:. Generate
+//
+// bitmapwithruns.bin and bitmapwithoutruns.bin are the 32-bit bitmaps documented by RoaringFormatSpec.
+// The 64-bit fixtures are written by Roaring64NavigableMap.serialize in the legacy layout,
+// <name>.bin with signedLongs=false and <name>.signed.bin with signedLongs=true.
+import java.io.DataOutputStream;
+import java.io.FileOutputStream;
+import java.io.IOException;
+
+import org.roaringbitmap.RoaringBitmap;
+import org.roaringbitmap.longlong.Roaring64NavigableMap;
+
+public class Generate {
+  static final long TOP = Long.MIN_VALUE;
+  static final long KEY_STEP = (1L << 32) + 1;
+
+  // keep in sync with ../cpp/generate.cpp and the manifest entries of these files,
+  // every span holds first, first+step, ... up to last
+  static final Object[][] FIXTURES = {
+    {"empty", false, new long[][] {}},
+    {"single", false, new long[][] {{42, 42, 1}}},
+    {"maxuint64", false, new long[][] {{-1L, -1L, 1}}},
+    {"dense", false, new long[][] {{1L << 32, (1L << 32) + 131070, 2}}},
+    {"runs", true, new long[][] {{0, 99999, 1}, {1L << 33, (1L << 33) + 4999999, 1}, {TOP, TOP + 99999, 1}}},
+    {"manykeys", false, new long[][] {{0, 999 * KEY_STEP, KEY_STEP}, {TOP, TOP + 999 * KEY_STEP, KEY_STEP}}},
+  };
+
+  public static void main(String[] args) throws IOException {
+    System.out.println("RoaringBitmap " + RoaringBitmap.class.getPackage().getImplementationVersion());
+
+    RoaringBitmap rb = new RoaringBitmap();
+    for (int k = 0; k < 100000; k += 1000) {
+      rb.add(k);
+    }
+    for (int k = 100000; k < 200000; ++k) {
+      rb.add(3 * k);
+    }
+    for (int k = 700000; k < 800000; ++k) {
+      rb.add(k);
+    }
+    write(rb, "bitmapwithoutruns.bin");
+    rb.runOptimize();
+    write(rb, "bitmapwithruns.bin");
+
+    Roaring64NavigableMap.SERIALIZATION_MODE = Roaring64NavigableMap.SERIALIZATION_MODE_LEGACY;
+    for (Object[] f : FIXTURES) {
+      for (boolean signedLongs : new boolean[] {false, true}) {
+        Roaring64NavigableMap map = new Roaring64NavigableMap(signedLongs);
+        for (long[] span : (long[][]) f[2]) {
+          for (long v = span[0]; ; v += span[2]) {
+            map.addLong(v);
+            if (Long.compareUnsigned(span[1] - v, span[2]) < 0) {
+              break;
+            }
+          }
+        }
+        if ((Boolean) f[1]) {
+          map.runOptimize();
+        }
+        write(map, f[0] + (signedLongs ? ".signed.bin" : ".bin"));
+      }
+    }
+  }
+
+  static void write(RoaringBitmap rb, String name) throws IOException {
+    try (DataOutputStream out = new DataOutputStream(new FileOutputStream(name))) {
+      rb.serialize(out);
+    }
+  }
+
+  static void write(Roaring64NavigableMap map, String name) throws IOException {
+    try (DataOutputStream out = new DataOutputStream(new FileOutputStream(name))) {
+      map.serialize(out);
+    }
+  }
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"math"
-	"strconv"
 	"sync"
 
 	"github.com/RoaringBitmap/roaring"
@@ -20,8 +19,12 @@ func New(values ...uint64) *BTreemap {
 }
 
 type BTreemap struct {
-	tree       *btree.BTree
-	serializer serializer
+	tree         *btree.BTree
+	serializer   serializer
+	jsonEncoding JSONEncoding
+	// cardinalities is only set by WithCardinalityIndex, budget by WithSizeLimit
+	cardinalities *cardinalityIndex
+	budget        *sizeBudget
 }
 
 func (tm *BTreemap) forEachBitmap(callback func(bm *keyedBitmap) bool) {
@@ -46,6 +49,7 @@ func (tm *BTreemap) AddMany(values []uint64) {
 func (tm *BTreemap) CheckedAdd(value uint64) bool {
 	key, hi, lo, cleanup := tm.makeKey(value)
 	defer cleanup()
+	tm.invalidate()
 
 	bm, found := tm.get(key)
 	if found {
@@ -82,6 +86,7 @@ func (tm *BTreemap) makeKey(value uint64) (btree.Item, uint32, uint32, func()) {
 func (tm *BTreemap) Add(value uint64) {
 	key, hi, lo, cleanup := tm.makeKey(value)
 	defer cleanup()
+	tm.invalidate()
 
 	bm, found := tm.get(key)
 	if found {
@@ -106,10 +111,25 @@ func (tm *BTreemap) IsEmpty() bool {
 }
 
 func (tm *BTreemap) Clear() {
+	tm.tree = btree.New(2, nil)
+}
+
+// Compact drops the keys that hold no values and copies every bitmap into containers sized to
+// their contents, releasing the capacity left behind by removals. With runOptimize the containers
+// are converted to runs where that's smaller first.
+func (tm *BTreemap) Compact(runOptimize bool) {
+	tree := btree.New(2, nil)
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		bm.Clear()
+		if bm.IsEmpty() {
+			return true
+		}
+		if runOptimize {
+			bm.RunOptimize()
+		}
+		tree.ReplaceOrInsert(bm.ClonePtr())
 		return true
 	})
+	tm.tree = tree
 }
 
 func (tm *BTreemap) Contains(value uint64) bool {
@@ -131,6 +151,7 @@ func (tm *BTreemap) CheckedRemove(value uint64) bool {
 	if !found {
 		return false
 	}
+	tm.invalidate()
 
 	removed := bm.CheckedRemove(lo)
 	if bm.IsEmpty() {
@@ -148,6 +169,7 @@ func (tm *BTreemap) Remove(value uint64) {
 	if !found {
 		return
 	}
+	tm.invalidate()
 
 	bm.Remove(lo)
 	if bm.IsEmpty() {
@@ -156,6 +178,9 @@ func (tm *BTreemap) Remove(value uint64) {
 }
 
 func (tm *BTreemap) GetCardinality() uint64 {
+	if c := tm.index(); c != nil {
+		return c.total
+	}
 	var card uint64
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
 		if bm.IsEmpty() {
@@ -186,6 +211,7 @@ func (tm *BTreemap) Maximum() uint64 {
 }
 
 func (tm *BTreemap) And(other *BTreemap) {
+	tm.invalidate()
 	var toRemove []btree.Item
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
 		rbm, found := other.get(bm)
@@ -224,6 +250,7 @@ func (tm *BTreemap) AndCardinality(other *BTreemap) uint64 {
 }
 
 func (tm *BTreemap) Or(other *BTreemap) {
+	tm.invalidate()
 	other.forEachBitmap(func(bm *keyedBitmap) bool {
 		cur, found := tm.get(bm)
 		if !found {
@@ -263,6 +290,7 @@ func (tm *BTreemap) OrCardinality(other *BTreemap) uint64 {
 }
 
 func (tm *BTreemap) Xor(other *BTreemap) {
+	tm.invalidate()
 	var toRemove []btree.Item
 	other.forEachBitmap(func(bm *keyedBitmap) bool {
 		cur, found := tm.get(bm)
@@ -271,7 +299,9 @@ func (tm *BTreemap) Xor(other *BTreemap) {
 			return true
 		}
 
-		cur.Xor(bm.Bitmap)
+		// the in-place 32-bit xor and andnot remove emptied containers one at a time,
+		// which is quadratic when whole keys cancel out
+		cur.Bitmap = roaring.Xor(cur.Bitmap, bm.Bitmap)
 		if cur.IsEmpty() {
 			toRemove = append(toRemove, bm)
 		}
@@ -283,13 +313,21 @@ func (tm *BTreemap) Xor(other *BTreemap) {
 }
 
 func (tm *BTreemap) AndNot(other *BTreemap) {
+	tm.invalidate()
+	var toRemove []btree.Item
 	tm.forEachBitmap(func(node *keyedBitmap) bool {
 		obm, found := other.get(node)
 		if found {
-			node.AndNot(obm.Bitmap)
+			node.Bitmap = roaring.AndNot(node.Bitmap, obm.Bitmap)
+			if node.IsEmpty() {
+				toRemove = append(toRemove, node)
+			}
 		}
 		return true
 	})
+	for _, key := range toRemove {
+		tm.tree.Delete(key)
+	}
 }
 
 func (tm *BTreemap) get(bm btree.Item) (*keyedBitmap, bool) {
@@ -304,6 +342,7 @@ func (tm *BTreemap) getOrInsert(highBits uint32) *keyedBitmap {
 	key, cleanup := makeKey(highBits)
 	defer cleanup()
 
+	tm.invalidate()
 	ebm, gotEnd := tm.get(key)
 	if !gotEnd {
 		ebm = &keyedBitmap{
@@ -329,6 +368,12 @@ func (tm *BTreemap) ToArray() []uint64 {
 
 func (tm *BTreemap) Clone() *BTreemap {
 	cloned := New()
+	if tm.cardinalities != nil {
+		cloned.WithCardinalityIndex()
+	}
+	if tm.budget != nil {
+		cloned.WithSizeLimit(tm.budget.limit)
+	}
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
 		cloned.tree.ReplaceOrInsert(bm.ClonePtr())
 		return true
@@ -390,6 +435,9 @@ func (tm *BTreemap) Intersects(other *BTreemap) bool {
 }
 
 func (tm *BTreemap) Rank(value uint64) uint64 {
+	if c := tm.index(); c != nil {
+		return c.rank(value)
+	}
 	var result uint64
 	hi, lo := splitHiLo(value)
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
@@ -411,6 +459,14 @@ func (tm *BTreemap) Select(value uint64) (uint64, error) {
 	if sz <= value {
 		return 0, fmt.Errorf("can't find %dth integer in a bitmap with only %d items", value, sz)
 	}
+	if c := tm.index(); c != nil {
+		key := c.keys[c.find(value)]
+		v, err := key.bm.Select(uint32(value - key.before))
+		if err != nil {
+			return 0, fmt.Errorf("can't find %dth integer in a bitmap with only %d items", value, sz)
+		}
+		return joinHiLo(key.bm.HighBits, v), nil
+	}
 	var result uint64
 	var failed bool
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
@@ -434,120 +490,239 @@ func (tm *BTreemap) Select(value uint64) (uint64, error) {
 	return result, nil
 }
 
-func (tm *BTreemap) String() string {
-	// inspired by https://github.com/fzandona/goroar/
-	var buffer bytes.Buffer
-	start := []byte("{")
-	buffer.Write(start)
-	i := tm.Iterator()
-	counter := 0
-	if i.HasNext() {
-		counter = counter + 1
-		buffer.WriteString(strconv.FormatInt(int64(i.Next()), 10))
-	}
-	for i.HasNext() {
-		buffer.WriteString(",")
-		counter = counter + 1
-		// to avoid exhausting the memory
-		if counter > 0x40000 {
-			buffer.WriteString("...")
+// Page returns up to limit values in ascending order, starting with the value of rank offset
+func (tm *BTreemap) Page(offset, limit uint64) []uint64 {
+	end := offset + limit
+	if end < offset {
+		end = math.MaxUint64
+	}
+	return tm.SelectRange(offset, end)
+}
+
+// SelectRange returns the values with a rank in [fromRank, toRank) in ascending order,
+// ranks past the cardinality are ignored. Keys before the window are skipped by their cardinality.
+func (tm *BTreemap) SelectRange(fromRank, toRank uint64) []uint64 {
+	var values []uint64
+	if fromRank >= toRank {
+		return values
+	}
+	if c := tm.index(); c != nil {
+		if fromRank >= c.total {
+			return values
+		}
+		for i := c.find(fromRank); i < len(c.keys) && fromRank < toRank; i++ {
+			key, after := c.keys[i], c.after(i)
+			to := toRank
+			if to > after {
+				to = after
+			}
+			values = appendRanks(values, key.bm, fromRank-key.before, to-key.before)
+			fromRank = after
+		}
+		return values
+	}
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		card := bm.GetCardinality()
+		if fromRank >= card {
+			fromRank -= card
+			toRank -= card
+			return true
+		}
+		if toRank <= card {
+			values = appendRanks(values, bm, fromRank, toRank)
+			return false
+		}
+		values = appendRanks(values, bm, fromRank, card)
+		fromRank, toRank = 0, toRank-card
+		return true
+	})
+	return values
+}
+
+// appendRanks appends the values of bm with a rank in [from, to), both within its cardinality
+func appendRanks(values []uint64, bm *keyedBitmap, from, to uint64) []uint64 {
+	lo := bm.Bitmap
+	if from > 0 || to < bm.GetCardinality() {
+		first, _ := bm.Select(uint32(from))
+		last, _ := bm.Select(uint32(to - 1))
+		lo = roaring.And(lo, rangeBitmap(uint64(first), uint64(last)+1))
+	}
+
+	n := len(values)
+	values = append(values, make([]uint64, to-from)...)
+	it := lo.ManyIterator()
+	for buf := values[n:]; len(buf) > 0; {
+		read := it.NextMany64(uint64(bm.HighBits)<<32, buf)
+		if read == 0 {
 			break
 		}
-		buffer.WriteString(strconv.FormatInt(int64(i.Next()), 10))
+		buf = buf[read:]
 	}
-	buffer.WriteString("}")
+	return values
+}
+
+func (tm *BTreemap) String() string {
+	var buffer bytes.Buffer
+	// to avoid exhausting the memory
+	tm.writeText(&buffer, 0x40000)
 	return buffer.String()
 }
 
 func (tm *BTreemap) Stats() (stats roaring.Statistics) {
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		st := bm.Bitmap.Stats()
-		stats.Cardinality += st.Cardinality
-		stats.Containers += st.Containers
-
-		stats.ArrayContainers += st.ArrayContainerBytes
-		stats.ArrayContainerBytes += st.ArrayContainerBytes
-		stats.ArrayContainerValues += st.ArrayContainerValues
-
-		stats.BitmapContainers += st.BitmapContainers
-		stats.BitmapContainerBytes += st.BitmapContainerBytes
-		stats.BitmapContainerValues += st.BitmapContainerValues
-
-		stats.RunContainers += st.RunContainers
-		stats.RunContainerBytes += st.RunContainerBytes
-		stats.RunContainerValues += st.RunContainerValues
+		addStatistics(&stats, bm.Bitmap.Stats())
 		return true
 	})
 	return
 }
 
 func (tm *BTreemap) Flip(rangeStart, rangeEnd uint64) {
-	hiStart, loStart := splitHiLo(rangeStart)
-	hiEnd, loEnd := splitHiLo(rangeEnd)
-
-	if hiStart == hiEnd {
-		tm.getOrInsert(hiStart).Flip(uint64(loStart), uint64(loEnd))
+	if rangeStart >= rangeEnd {
 		return
 	}
+	tm.flipRangeClosed(rangeStart, rangeEnd-1)
+}
 
-	bm := tm.getOrInsert(hiStart)
-	bm.Bitmap.Flip(uint64(loStart), math.MaxUint32)
+// flipRangeClosed keeps keys compact: keys that end up full are rebuilt as run containers
+// and keys that end up empty are dropped
+func (tm *BTreemap) flipRangeClosed(first, last uint64) {
+	tm.invalidate()
+	forEachKeyRange(first, last, func(hi uint32, lo, end uint64) {
+		key, cleanup := makeKey(hi)
+		defer cleanup()
 
-	for cur := hiStart + 1; cur < loEnd-1; cur++ {
-		cbm := tm.getOrInsert(cur)
-		cbm.Flip(0, math.MaxUint32)
-	}
+		bm, found := tm.get(key)
+		if !found {
+			tm.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: rangeBitmap(lo, end), HighBits: hi})
+			return
+		}
 
-	ebm := tm.getOrInsert(hiEnd)
-	ebm.Flip(0, uint64(loEnd))
+		inRange := bm.Rank(uint32(end - 1))
+		if lo > 0 {
+			inRange -= bm.Rank(uint32(lo - 1))
+		}
+		if bm.GetCardinality()-inRange+(end-lo-inRange) == math.MaxUint32+1 {
+			bm.Bitmap = rangeBitmap(0, math.MaxUint32+1)
+			return
+		}
+		// the in-place flip removes emptied containers one at a time, which is quadratic over a full key
+		bm.Bitmap = roaring.Flip(bm.Bitmap, lo, end)
+		if bm.IsEmpty() {
+			tm.tree.Delete(bm)
+		}
+	})
 }
 
 func (tm *BTreemap) FlipInt(rangeStart, rangeEnd int) {
 	tm.Flip(uint64(rangeStart), uint64(rangeEnd))
 }
 
-func (tm *BTreemap) AddRange(rangeStart, rangeEnd uint64) {
-	hiStart, loStart := splitHiLo(rangeStart)
-	hiEnd, loEnd := splitHiLo(rangeEnd)
+// Not negates the bitmap within [rangeStart, rangeEnd) in place, just like Flip
+func (tm *BTreemap) Not(rangeStart, rangeEnd uint64) {
+	tm.Flip(rangeStart, rangeEnd)
+}
 
-	if hiStart == hiEnd {
-		tm.getOrInsert(hiStart).AddRange(uint64(loStart), uint64(loEnd))
-		return
+// Complement returns every value in [universeStart, universeEnd) that is not in the bitmap.
+// High keys the bitmap doesn't touch come out as run containers.
+func (tm *BTreemap) Complement(universeStart, universeEnd uint64) *BTreemap {
+	result := New()
+	if universeStart >= universeEnd {
+		return result
 	}
+	forEachKeyRange(universeStart, universeEnd-1, func(hi uint32, lo, end uint64) {
+		key, cleanup := makeKey(hi)
+		defer cleanup()
 
-	bm := tm.getOrInsert(hiStart)
-	bm.Bitmap.AddRange(uint64(loStart), math.MaxUint32)
-
-	for cur := hiStart + 1; cur < loEnd-1; cur++ {
-		cbm := tm.getOrInsert(cur)
-		cbm.AddRange(0, math.MaxUint32)
-	}
+		missing := rangeBitmap(lo, end)
+		if bm, found := tm.get(key); found {
+			missing = roaring.AndNot(missing, bm.Bitmap)
+		}
+		if !missing.IsEmpty() {
+			result.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: missing, HighBits: hi})
+		}
+	})
+	return result
+}
 
-	ebm := tm.getOrInsert(hiEnd)
-	ebm.AddRange(0, uint64(loEnd))
+// rangeBitmap holds [lo, end) as run containers
+func rangeBitmap(lo, end uint64) *roaring.Bitmap {
+	bm := roaring.New()
+	bm.AddRange(lo, end)
+	return bm
 }
 
-func (tm *BTreemap) RemoveRange(rangeStart, rangeEnd uint64) {
-	hiStart, loStart := splitHiLo(rangeStart)
-	hiEnd, loEnd := splitHiLo(rangeEnd)
+// forEachKeyRange splits [first, last] at high key boundaries,
+// lo and end are the half-open low bits range within each high key
+func forEachKeyRange(first, last uint64, cb func(hi uint32, lo, end uint64)) {
+	hiStart, loStart := splitHiLo(first)
+	hiEnd, loEnd := splitHiLo(last)
 
-	if hiStart == hiEnd {
-		bm := tm.getOrInsert(hiStart)
-		bm.RemoveRange(uint64(loStart), uint64(loEnd))
-		if bm.IsEmpty() {
-			tm.tree.Delete(bm)
+	for hi := hiStart; ; hi++ {
+		var lo uint64
+		if hi == hiStart {
+			lo = uint64(loStart)
+		}
+		end := uint64(math.MaxUint32) + 1
+		if hi == hiEnd {
+			end = uint64(loEnd) + 1
+		}
+		cb(hi, lo, end)
+		if hi == hiEnd {
+			return
 		}
+	}
+}
+
+func (tm *BTreemap) AddRange(rangeStart, rangeEnd uint64) {
+	if rangeStart >= rangeEnd {
 		return
 	}
+	tm.addRangeClosed(rangeStart, rangeEnd-1)
+}
 
-	bm := tm.getOrInsert(hiStart)
-	bm.Bitmap.RemoveRange(uint64(loStart), math.MaxUint32)
+// addRangeClosed adds [first, last], so ranges that end at math.MaxUint64 can be expressed
+func (tm *BTreemap) addRangeClosed(first, last uint64) {
+	forEachKeyRange(first, last, func(hi uint32, lo, end uint64) {
+		tm.getOrInsert(hi).AddRange(lo, end)
+	})
+}
 
-	for cur := hiStart + 1; cur < loEnd-1; cur++ {
-		cbm := tm.getOrInsert(cur)
-		cbm.RemoveRange(0, math.MaxUint32)
+func (tm *BTreemap) RemoveRange(rangeStart, rangeEnd uint64) {
+	if rangeStart >= rangeEnd {
+		return
 	}
+	tm.removeRangeClosed(rangeStart, rangeEnd-1)
+}
+
+// removeRangeClosed only visits the keys that exist in [first, last]
+func (tm *BTreemap) removeRangeClosed(first, last uint64) {
+	tm.invalidate()
+	hiStart, loStart := splitHiLo(first)
+	hiEnd, loEnd := splitHiLo(last)
+	key, cleanup := makeKey(hiStart)
+	defer cleanup()
 
-	ebm := tm.getOrInsert(hiEnd)
-	ebm.RemoveRange(0, uint64(loEnd))
+	var toRemove []btree.Item
+	tm.tree.AscendGreaterOrEqual(key, func(i btree.Item) bool {
+		bm := i.(*keyedBitmap)
+		if bm.HighBits > hiEnd {
+			return false
+		}
+		var lo uint64
+		if bm.HighBits == hiStart {
+			lo = uint64(loStart)
+		}
+		end := uint64(math.MaxUint32) + 1
+		if bm.HighBits == hiEnd {
+			end = uint64(loEnd) + 1
+		}
+		bm.RemoveRange(lo, end)
+		if bm.IsEmpty() {
+			toRemove = append(toRemove, bm)
+		}
+		return true
+	})
+	for _, item := range toRemove {
+		tm.tree.Delete(item)
+	}
 }
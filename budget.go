@@ -0,0 +1,154 @@
+package roaring64
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/tidwall/btree"
+)
+
+// ErrSizeLimit is returned by the Try mutations when the result wouldn't fit the size limit
+var ErrSizeLimit = errors.New("size limit exceeded")
+
+// sizeBudget tracks GetSizeInBytes as the sum of the size of every key. The Try mutations
+// keep it up to date, any other mutation marks it stale and the next Try measures again.
+type sizeBudget struct {
+	limit uint64
+	tree  *btree.BTree
+	used  uint64
+}
+
+// WithSizeLimit bounds GetSizeInBytes for TryAdd, TryAddRange and TryOr. When a mutation goes over
+// the limit the keys it touched are run optimized, and if that isn't enough the mutation is undone
+// and fails with ErrSizeLimit. The other mutations aren't checked. A limit of 0 removes the bound.
+func (tm *BTreemap) WithSizeLimit(maxBytes uint64) *BTreemap {
+	tm.budget = nil
+	if maxBytes > 0 {
+		tm.budget = &sizeBudget{limit: maxBytes}
+	}
+	return tm
+}
+
+// usedBytes returns GetSizeInBytes, measuring it only when a mutation outside the Try variants happened
+func (tm *BTreemap) usedBytes() uint64 {
+	b := tm.budget
+	if b.tree != tm.tree {
+		b.used = tm.GetSizeInBytes()
+		b.tree = tm.tree
+	}
+	return b.used
+}
+
+// setUsedBytes records the size after a Try mutation, which invalidated it like every mutation
+func (tm *BTreemap) setUsedBytes(used uint64) {
+	tm.budget.used = used
+	tm.budget.tree = tm.tree
+}
+
+// keySize is the contribution of one key to GetSizeInBytes
+func keySize(bm *roaring.Bitmap) uint64 {
+	return 4 + bm.GetSizeInBytes()
+}
+
+// TryAdd adds value unless that takes the bitmap over its size limit
+func (tm *BTreemap) TryAdd(value uint64) error {
+	if tm.budget == nil {
+		tm.Add(value)
+		return nil
+	}
+	used := tm.usedBytes()
+
+	key, hi, lo, cleanup := tm.makeKey(value)
+	defer cleanup()
+
+	var before uint64
+	if bm, found := tm.get(key); found {
+		if bm.Contains(lo) {
+			return nil
+		}
+		before = keySize(bm.Bitmap)
+	}
+	bm := tm.getOrInsert(hi)
+	bm.Add(lo)
+	after := keySize(bm.Bitmap)
+	if used-before+after > tm.budget.limit {
+		bm.RunOptimize()
+		after = keySize(bm.Bitmap)
+	}
+	if needed := used - before + after; needed > tm.budget.limit {
+		tm.Remove(value)
+		after = 0
+		if bm, found := tm.get(key); found {
+			after = keySize(bm.Bitmap)
+		}
+		tm.setUsedBytes(used - before + after)
+		return fmt.Errorf("%w: adding %d needs %d bytes, the limit is %d", ErrSizeLimit, value, needed, tm.budget.limit)
+	}
+	tm.setUsedBytes(used - before + after)
+	return nil
+}
+
+// TryAddRange adds [rangeStart, rangeEnd) unless that takes the bitmap over its size limit
+func (tm *BTreemap) TryAddRange(rangeStart, rangeEnd uint64) error {
+	if rangeStart >= rangeEnd {
+		return nil
+	}
+	values := New()
+	values.addRangeClosed(rangeStart, rangeEnd-1)
+	return tm.TryOr(values)
+}
+
+// TryOr merges other into tm unless that takes the bitmap over its size limit,
+// the merged keys are built on the side so a failure leaves tm as it was
+func (tm *BTreemap) TryOr(other *BTreemap) error {
+	if tm.budget == nil {
+		tm.Or(other)
+		return nil
+	}
+	used := tm.usedBytes()
+
+	type change struct {
+		cur    *keyedBitmap
+		merged *keyedBitmap
+	}
+	var changes []change
+	other.forEachBitmap(func(bm *keyedBitmap) bool {
+		if bm.IsEmpty() {
+			return true
+		}
+		cur, found := tm.get(bm)
+		if !found {
+			merged := bm.ClonePtr()
+			changes = append(changes, change{merged: merged})
+			used += keySize(merged.Bitmap)
+			return true
+		}
+		merged := &keyedBitmap{Bitmap: roaring.Or(cur.Bitmap, bm.Bitmap), HighBits: bm.HighBits}
+		changes = append(changes, change{cur: cur, merged: merged})
+		used = used - keySize(cur.Bitmap) + keySize(merged.Bitmap)
+		return true
+	})
+
+	if used > tm.budget.limit {
+		for _, c := range changes {
+			before := keySize(c.merged.Bitmap)
+			c.merged.RunOptimize()
+			used = used - before + keySize(c.merged.Bitmap)
+		}
+	}
+	if used > tm.budget.limit {
+		return fmt.Errorf("%w: the union needs %d bytes, the limit is %d", ErrSizeLimit, used, tm.budget.limit)
+	}
+
+	tm.invalidate()
+	for _, c := range changes {
+		if c.cur != nil {
+			c.cur.Bitmap = c.merged.Bitmap
+			continue
+		}
+		tm.tree.ReplaceOrInsert(c.merged)
+	}
+	tm.setUsedBytes(used)
+	return nil
+}
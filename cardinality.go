@@ -0,0 +1,97 @@
+package roaring64
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/tidwall/btree"
+)
+
+// cardinalityIndex holds the number of values before every non-empty key, in key order.
+// It's rebuilt on first use after a mutation; mutations that replace the tree invalidate it
+// implicitly because it remembers the tree it was built from.
+type cardinalityIndex struct {
+	// mu serializes readers rebuilding the index, writers already exclude readers
+	mu    sync.Mutex
+	tree  *btree.BTree
+	keys  []indexedKey
+	total uint64
+}
+
+type indexedKey struct {
+	bm     *keyedBitmap
+	before uint64
+}
+
+// WithCardinalityIndex makes GetCardinality O(1) and Rank, Select and SelectRange O(log keys)
+// plus the work in the 32-bit bitmap, by caching the cumulative cardinality of every key.
+// The index is dropped by every mutation and rebuilt by the next query,
+// so it pays off when queries outnumber mutations.
+func (tm *BTreemap) WithCardinalityIndex() *BTreemap {
+	tm.cardinalities = &cardinalityIndex{}
+	return tm
+}
+
+// invalidate drops the cardinality index and the tracked size after the values of a key changed in place
+func (tm *BTreemap) invalidate() {
+	if tm.cardinalities != nil {
+		tm.cardinalities.tree = nil
+	}
+	if tm.budget != nil {
+		tm.budget.tree = nil
+	}
+}
+
+// index returns the cardinality index, building it when needed, or nil when it isn't enabled
+func (tm *BTreemap) index() *cardinalityIndex {
+	c := tm.cardinalities
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.tree != tm.tree {
+		c.build(tm)
+	}
+	return c
+}
+
+func (c *cardinalityIndex) build(tm *BTreemap) {
+	c.keys = c.keys[:0]
+	c.total = 0
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		if card := bm.GetCardinality(); card > 0 {
+			c.keys = append(c.keys, indexedKey{bm: bm, before: c.total})
+			c.total += card
+		}
+		return true
+	})
+	c.tree = tm.tree
+}
+
+// rank returns the number of values up to and including value
+func (c *cardinalityIndex) rank(value uint64) uint64 {
+	hi, lo := splitHiLo(value)
+	i := sort.Search(len(c.keys), func(i int) bool { return c.keys[i].bm.HighBits > hi })
+	if i == 0 {
+		return 0
+	}
+	if key := c.keys[i-1]; key.bm.HighBits == hi {
+		return key.before + key.bm.Rank(lo)
+	}
+	return c.after(i - 1)
+}
+
+// find returns the position of the key holding the value of the given rank, which must be below total
+func (c *cardinalityIndex) find(rank uint64) int {
+	return sort.Search(len(c.keys), func(i int) bool { return c.keys[i].before > rank }) - 1
+}
+
+// after returns the number of values up to and including the key at position i
+func (c *cardinalityIndex) after(i int) uint64 {
+	if i+1 < len(c.keys) {
+		return c.keys[i+1].before
+	}
+	return c.total
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	roaring64 "github.com/casualjim/go-roaring64"
+)
+
+var errUsage = errors.New(`usage:
+	roaring64 stats [--format f] [file]
+	roaring64 dump [--format f] [file]
+	roaring64 ranges [--format f] [file]
+	roaring64 convert [--from f] --to f [-o out] [file]
+	roaring64 and|or|xor|andnot [--format f] [--to f] [-o out] file file...
+	roaring64 contains|rank|select [--format f] file value...
+	roaring64 validate [--format f] [--max-keys n] [--max-bytes n] [--max-cardinality n] [file...]
+formats are cpp, jvm or auto`)
+
+var commands = map[string]func(*env, []string) error{
+	"stats":    cmdStats,
+	"dump":     cmdDump,
+	"ranges":   cmdRanges,
+	"convert":  cmdConvert,
+	"and":      setOp((*roaring64.BTreemap).And),
+	"or":       setOp((*roaring64.BTreemap).Or),
+	"xor":      setOp((*roaring64.BTreemap).Xor),
+	"andnot":   setOp((*roaring64.BTreemap).AndNot),
+	"contains": query(func(tm *roaring64.BTreemap, v uint64) (string, error) { return strconv.FormatBool(tm.Contains(v)), nil }),
+	"rank":     query(func(tm *roaring64.BTreemap, v uint64) (string, error) { return strconv.FormatUint(tm.Rank(v), 10), nil }),
+	"select": query(func(tm *roaring64.BTreemap, v uint64) (string, error) {
+		x, err := tm.Select(v)
+		return strconv.FormatUint(x, 10), err
+	}),
+	"validate": cmdValidate,
+}
+
+type env struct {
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type formatFlag struct {
+	format roaring64.Format
+	auto   bool
+}
+
+func (f *formatFlag) String() string {
+	if f.auto {
+		return "auto"
+	}
+	return f.format.String()
+}
+
+func (f *formatFlag) Set(s string) error {
+	switch s {
+	case "auto":
+		f.auto = true
+	case "cpp", "portable":
+		f.format, f.auto = roaring64.FormatCpp, false
+	case "jvm":
+		f.format, f.auto = roaring64.FormatJvm, false
+	default:
+		return fmt.Errorf("unknown format %q", s)
+	}
+	return nil
+}
+
+func newFlags(name string) (*flag.FlagSet, *formatFlag) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	format := &formatFlag{auto: true}
+	fs.Var(format, "format", "input format: cpp, jvm or auto")
+	return fs, format
+}
+
+func (e *env) readAll(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return ioutil.ReadAll(e.stdin)
+	}
+	return ioutil.ReadFile(name)
+}
+
+func (e *env) load(name string, format *formatFlag, opts roaring64.ReadOptions) (*roaring64.BTreemap, error) {
+	data, err := e.readAll(name)
+	if err != nil {
+		return nil, err
+	}
+	f := format.format
+	if format.auto {
+		if f, err = roaring64.DetectFormat(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %v", displayName(name), err)
+		}
+	}
+	tm := roaring64.New().WithFormat(f)
+	if _, err := tm.FromBufferWithOptions(data, opts); err != nil {
+		return nil, fmt.Errorf("%s: %v", displayName(name), err)
+	}
+	return tm, nil
+}
+
+func (e *env) save(name string, tm *roaring64.BTreemap) error {
+	if name == "" || name == "-" {
+		_, err := tm.WriteTo(e.stdout)
+		return err
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := tm.WriteTo(f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func displayName(name string) string {
+	if name == "" || name == "-" {
+		return "stdin"
+	}
+	return name
+}
+
+func singleFile(fs *flag.FlagSet) (string, error) {
+	switch fs.NArg() {
+	case 0:
+		return "-", nil
+	case 1:
+		return fs.Arg(0), nil
+	default:
+		return "", errUsage
+	}
+}
+
+func cmdStats(e *env, args []string) error {
+	fs, format := newFlags("stats")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name, err := singleFile(fs)
+	if err != nil {
+		return err
+	}
+	tm, err := e.load(name, format, roaring64.ReadOptions{})
+	if err != nil {
+		return err
+	}
+
+	st := tm.Stats64(false)
+	w := bufio.NewWriter(e.stdout)
+	fmt.Fprintf(w, "format: %v\n", tm.Format())
+	fmt.Fprintf(w, "serialized bytes: %d\n", tm.GetSerializedSizeInBytes())
+	fmt.Fprintf(w, "in-memory bytes: %d\n", tm.GetSizeInBytes())
+	if !tm.IsEmpty() {
+		fmt.Fprintf(w, "minimum: %d\nmaximum: %d\n", tm.Minimum(), tm.Maximum())
+	}
+	fmt.Fprintf(w, "cardinality: %d\n", st.Cardinality)
+	fmt.Fprintf(w, "high keys: %d (%d empty)\n", st.Keys, st.EmptyKeys)
+	fmt.Fprintf(w, "btree overhead bytes: %d (depth at most %d)\n", st.TreeOverheadBytes, st.TreeDepthBound)
+	fmt.Fprintf(w, "containers: %d\n", st.Containers)
+	fmt.Fprintf(w, "array containers: %d (%d values, %d bytes)\n", st.ArrayContainers, st.ArrayContainerValues, st.ArrayContainerBytes)
+	fmt.Fprintf(w, "bitmap containers: %d (%d values, %d bytes)\n", st.BitmapContainers, st.BitmapContainerValues, st.BitmapContainerBytes)
+	fmt.Fprintf(w, "run containers: %d (%d values, %d bytes)\n", st.RunContainers, st.RunContainerValues, st.RunContainerBytes)
+	for i, keys := range st.CardinalityHistogram {
+		if keys > 0 {
+			fmt.Fprintf(w, "keys with cardinality in [2^%d, 2^%d): %d\n", i, i+1, keys)
+		}
+	}
+	return w.Flush()
+}
+
+func cmdDump(e *env, args []string) error {
+	fs, format := newFlags("dump")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name, err := singleFile(fs)
+	if err != nil {
+		return err
+	}
+	tm, err := e.load(name, format, roaring64.ReadOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(e.stdout)
+	buf := make([]byte, 0, 24)
+	tm.Iterate(func(x uint64) bool {
+		buf = append(strconv.AppendUint(buf[:0], x, 10), '\n')
+		_, err = w.Write(buf)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func cmdRanges(e *env, args []string) error {
+	fs, format := newFlags("ranges")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	name, err := singleFile(fs)
+	if err != nil {
+		return err
+	}
+	tm, err := e.load(name, format, roaring64.ReadOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(e.stdout)
+	writeRange := func(first, last uint64) {
+		if first == last {
+			fmt.Fprintf(w, "%d\n", first)
+			return
+		}
+		fmt.Fprintf(w, "%d-%d\n", first, last)
+	}
+	var first, last uint64
+	started := false
+	tm.Iterate(func(x uint64) bool {
+		if started && x == last+1 {
+			last = x
+			return true
+		}
+		if started {
+			writeRange(first, last)
+		}
+		first, last, started = x, x, true
+		return true
+	})
+	if started {
+		writeRange(first, last)
+	}
+	return w.Flush()
+}
+
+func cmdConvert(e *env, args []string) error {
+	fs, from := newFlags("convert")
+	fs.Var(from, "from", "input format: cpp, jvm or auto")
+	to := &formatFlag{auto: true}
+	fs.Var(to, "to", "output format: cpp or jvm")
+	out := fs.String("o", "-", "output file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if to.auto {
+		return errors.New("convert needs an output format, use --to cpp or --to jvm")
+	}
+	name, err := singleFile(fs)
+	if err != nil {
+		return err
+	}
+	tm, err := e.load(name, from, roaring64.ReadOptions{})
+	if err != nil {
+		return err
+	}
+	return e.save(*out, tm.WithFormat(to.format))
+}
+
+func setOp(op func(*roaring64.BTreemap, *roaring64.BTreemap)) func(*env, []string) error {
+	return func(e *env, args []string) error {
+		fs, format := newFlags("set operation")
+		to := &formatFlag{auto: true}
+		fs.Var(to, "to", "output format, defaults to the format of the first input")
+		out := fs.String("o", "-", "output file")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() < 2 {
+			return errUsage
+		}
+
+		result, err := e.load(fs.Arg(0), format, roaring64.ReadOptions{})
+		if err != nil {
+			return err
+		}
+		for _, name := range fs.Args()[1:] {
+			tm, err := e.load(name, format, roaring64.ReadOptions{})
+			if err != nil {
+				return err
+			}
+			op(result, tm)
+		}
+		if !to.auto {
+			result.WithFormat(to.format)
+		}
+		return e.save(*out, result)
+	}
+}
+
+func query(fn func(*roaring64.BTreemap, uint64) (string, error)) func(*env, []string) error {
+	return func(e *env, args []string) error {
+		fs, format := newFlags("query")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() < 2 {
+			return errUsage
+		}
+		tm, err := e.load(fs.Arg(0), format, roaring64.ReadOptions{})
+		if err != nil {
+			return err
+		}
+
+		w := bufio.NewWriter(e.stdout)
+		for _, arg := range fs.Args()[1:] {
+			v, err := strconv.ParseUint(arg, 10, 64)
+			if err != nil {
+				return err
+			}
+			res, err := fn(tm, v)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%d\t%s\n", v, res)
+		}
+		return w.Flush()
+	}
+}
+
+func cmdValidate(e *env, args []string) error {
+	fs, format := newFlags("validate")
+	var opts roaring64.ReadOptions
+	fs.Uint64Var(&opts.MaxKeys, "max-keys", 0, "maximum number of high keys")
+	fs.Int64Var(&opts.MaxBytes, "max-bytes", 0, "maximum serialized size")
+	fs.Uint64Var(&opts.MaxCardinality, "max-cardinality", 0, "maximum number of values")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := fs.Args()
+	if len(names) == 0 {
+		names = []string{"-"}
+	}
+
+	var failed int
+	for _, name := range names {
+		tm, err := e.load(name, format, opts)
+		if err != nil {
+			failed++
+			fmt.Fprintln(e.stdout, err)
+			continue
+		}
+		fmt.Fprintf(e.stdout, "%s: ok, %v format, %d values\n", displayName(name), tm.Format(), tm.GetCardinality())
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files are invalid", failed, len(names))
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+// Command roaring64 inspects and converts serialized 64-bit roaring bitmaps.
+//
+// Every command reads the files named on the command line, or stdin when the name is - or missing.
+// The input format is detected unless --format is given.
+//
+//	roaring64 stats [file]
+//	roaring64 dump [file]
+//	roaring64 ranges [file]
+//	roaring64 convert --from cpp --to jvm [-o out] [file]
+//	roaring64 and|or|xor|andnot [--to jvm] [-o out] file file...
+//	roaring64 contains|rank|select file value...
+//	roaring64 validate [--max-keys n] [--max-bytes n] [--max-cardinality n] [file...]
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "roaring64:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown command %q\n%v", args[0], errUsage)
+	}
+	err := cmd(&env{stdin: stdin, stdout: stdout}, args[1:])
+	if err == flag.ErrHelp {
+		return errUsage
+	}
+	return err
+}
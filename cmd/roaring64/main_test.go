@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	roaring64 "github.com/casualjim/go-roaring64"
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(t *testing.T, stdin []byte, args ...string) (string, error) {
+	var out bytes.Buffer
+	err := run(args, bytes.NewReader(stdin), &out)
+	return out.String(), err
+}
+
+func TestConvert(t *testing.T) {
+	cpp, err := ioutil.ReadFile("../../_data/testcpp.bin")
+	require.NoError(t, err)
+	jvm, err := ioutil.ReadFile("../../_data/testjvm.bin")
+	require.NoError(t, err)
+
+	out, err := runCmd(t, cpp, "convert", "--from", "cpp", "--to", "jvm")
+	require.NoError(t, err)
+	require.Equal(t, jvm, []byte(out))
+
+	out, err = runCmd(t, nil, "convert", "--to", "cpp", "../../_data/testjvm.bin")
+	require.NoError(t, err)
+	require.Equal(t, cpp, []byte(out))
+
+	_, err = runCmd(t, cpp, "convert")
+	require.Error(t, err)
+}
+
+func TestQueries(t *testing.T) {
+	out, err := runCmd(t, nil, "contains", "../../_data/testcpp.bin", "5", "100", "18446744073709551615")
+	require.NoError(t, err)
+	require.Equal(t, "5\tfalse\n100\ttrue\n18446744073709551615\ttrue\n", out)
+
+	out, err = runCmd(t, nil, "rank", "../../_data/testcpp.bin", "199")
+	require.NoError(t, err)
+	require.Equal(t, "199\t100\n", out)
+
+	out, err = runCmd(t, nil, "select", "../../_data/testcpp.bin", "0", "901")
+	require.NoError(t, err)
+	require.Equal(t, "0\t100\n901\t18446744073709551615\n", out)
+
+	out, err = runCmd(t, nil, "ranges", "../../_data/testjvm.bin")
+	require.NoError(t, err)
+	require.Equal(t, "100-999\n4294967295\n18446744073709551615\n", out)
+}
+
+func TestSetOps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roaring64-cli")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	write := func(name string, tm *roaring64.BTreemap) string {
+		data, err := tm.ToBytes()
+		require.NoError(t, err)
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+	a := write("a.bin", roaring64.New(1, 2, 3, math.MaxUint64))
+	b := write("b.bin", roaring64.New(2, 3, 4).WithJvmSerializer())
+
+	for op, expected := range map[string]string{
+		"and":    "2\n3\n",
+		"or":     "1\n2\n3\n4\n18446744073709551615\n",
+		"xor":    "1\n4\n18446744073709551615\n",
+		"andnot": "1\n18446744073709551615\n",
+	} {
+		out := filepath.Join(dir, op+".bin")
+		_, err := runCmd(t, nil, op, "-o", out, a, b)
+		require.NoError(t, err)
+
+		dump, err := runCmd(t, nil, "dump", out)
+		require.NoError(t, err)
+		require.Equal(t, expected, dump, op)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cpp, err := ioutil.ReadFile("../../_data/testcpp.bin")
+	require.NoError(t, err)
+
+	_, err = runCmd(t, cpp, "validate")
+	require.NoError(t, err)
+
+	out, err := runCmd(t, cpp[:len(cpp)-1], "validate")
+	require.Error(t, err)
+	require.Contains(t, out, "corrupt bitmap")
+
+	_, err = runCmd(t, cpp, "validate", "--max-cardinality", "10")
+	require.Error(t, err)
+
+	out, err = runCmd(t, cpp, "stats")
+	require.NoError(t, err)
+	require.Contains(t, out, "cardinality: 902")
+}
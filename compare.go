@@ -0,0 +1,144 @@
+package roaring64
+
+import (
+	"github.com/RoaringBitmap/roaring"
+	"github.com/tidwall/btree"
+)
+
+// keyWalker steps through the non-empty bitmaps of a tree in key order,
+// bm is nil once the tree is exhausted
+type keyWalker struct {
+	cursor *btree.Cursor
+	bm     *keyedBitmap
+}
+
+func newKeyWalker(tm *BTreemap) *keyWalker {
+	w := &keyWalker{cursor: tm.tree.Cursor()}
+	w.skipEmpty(w.cursor.First())
+	return w
+}
+
+func (w *keyWalker) next() {
+	w.skipEmpty(w.cursor.Next())
+}
+
+func (w *keyWalker) skipEmpty(item btree.Item) {
+	for item != nil && item.(*keyedBitmap).IsEmpty() {
+		item = w.cursor.Next()
+	}
+	if item == nil {
+		w.bm = nil
+		return
+	}
+	w.bm = item.(*keyedBitmap)
+}
+
+// hasNext reports whether a non-empty bitmap follows the current one, without moving
+func (w *keyWalker) hasNext() bool {
+	item := w.cursor.Next()
+	found := false
+	for ; item != nil; item = w.cursor.Next() {
+		if !item.(*keyedBitmap).IsEmpty() {
+			found = true
+			break
+		}
+	}
+	w.cursor.Seek(w.bm)
+	return found
+}
+
+// IsSubsetOf reports whether every value of tm is in other
+func (tm *BTreemap) IsSubsetOf(other *BTreemap) bool {
+	subset, _ := tm.subsetOf(other)
+	return subset
+}
+
+// IsStrictSubsetOf reports whether tm is a subset of other and other has values tm lacks
+func (tm *BTreemap) IsStrictSubsetOf(other *BTreemap) bool {
+	subset, strict := tm.subsetOf(other)
+	return subset && strict
+}
+
+// subsetOf walks both trees in lockstep and stops at the first value of tm missing in other,
+// strict reports whether other has values tm lacks
+func (tm *BTreemap) subsetOf(other *BTreemap) (subset, strict bool) {
+	l, r := newKeyWalker(tm), newKeyWalker(other)
+	for ; l.bm != nil; l.next() {
+		for r.bm != nil && r.bm.HighBits < l.bm.HighBits {
+			strict = true
+			r.next()
+		}
+		if r.bm == nil || r.bm.HighBits != l.bm.HighBits {
+			return false, false
+		}
+		lc, rc := l.bm.GetCardinality(), r.bm.GetCardinality()
+		if lc > rc || l.bm.AndCardinality(r.bm.Bitmap) != lc {
+			return false, false
+		}
+		strict = strict || lc < rc
+		r.next()
+	}
+	return true, strict || r.bm != nil
+}
+
+// IsDisjoint reports whether tm and other have no value in common
+func (tm *BTreemap) IsDisjoint(other *BTreemap) bool {
+	l, r := newKeyWalker(tm), newKeyWalker(other)
+	for l.bm != nil && r.bm != nil {
+		switch {
+		case l.bm.HighBits < r.bm.HighBits:
+			l.next()
+		case l.bm.HighBits > r.bm.HighBits:
+			r.next()
+		default:
+			if l.bm.Intersects(r.bm.Bitmap) {
+				return false
+			}
+			l.next()
+			r.next()
+		}
+	}
+	return true
+}
+
+// Compare orders bitmaps like their sorted values compare lexicographically,
+// a bitmap that is a prefix of the other sorts first. It returns -1, 0 or +1.
+func (tm *BTreemap) Compare(other *BTreemap) int {
+	l, r := newKeyWalker(tm), newKeyWalker(other)
+	for ; l.bm != nil && r.bm != nil; l.next() {
+		if l.bm.HighBits != r.bm.HighBits {
+			// the side with the smaller key has the smaller next value
+			if l.bm.HighBits < r.bm.HighBits {
+				return -1
+			}
+			return 1
+		}
+
+		diff := roaring.Xor(l.bm.Bitmap, r.bm.Bitmap)
+		if !diff.IsEmpty() {
+			// every value below first is shared, the side holding first has the smaller next value
+			// unless the other side has nothing left at all
+			first := diff.Minimum()
+			if l.bm.Contains(first) {
+				if r.bm.Maximum() > first || r.hasNext() {
+					return -1
+				}
+				return 1
+			}
+			if l.bm.Maximum() > first || l.hasNext() {
+				return 1
+			}
+			return -1
+		}
+		r.next()
+	}
+
+	switch {
+	case l.bm != nil:
+		return 1
+	case r.bm != nil:
+		return -1
+	default:
+		return 0
+	}
+}
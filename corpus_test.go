@@ -0,0 +1,177 @@
+package roaring64
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const corpusDir = "_data/corpus"
+
+type corpusSpan struct {
+	First string `json:"first"`
+	Last  string `json:"last"`
+	Step  string `json:"step"`
+}
+
+type corpusFixture struct {
+	Name        string       `json:"name"`
+	File        string       `json:"file"`
+	Format      string       `json:"format"`
+	SignedLongs bool         `json:"signedLongs"`
+	Producer    string       `json:"producer"`
+	SHA256      string       `json:"sha256"`
+	RunOptimize bool         `json:"runOptimize"`
+	ExactBytes  bool         `json:"exactBytes"`
+	Spans       []corpusSpan `json:"spans"`
+}
+
+func readCorpus(t *testing.T) []corpusFixture {
+	data, err := ioutil.ReadFile(filepath.Join(corpusDir, "manifest.json"))
+	require.NoError(t, err)
+	var manifest struct {
+		Fixtures []corpusFixture `json:"fixtures"`
+	}
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.NotEmpty(t, manifest.Fixtures)
+	return manifest.Fixtures
+}
+
+// read loads the fixture and checks it's still the file the other implementation wrote,
+// a missing file or sha256 fails so the corpus can't silently go missing
+func (f corpusFixture) read(t *testing.T) []byte {
+	require.NotEmpty(t, f.SHA256, "%s has no sha256 in the manifest", f.File)
+	data, err := ioutil.ReadFile(filepath.Join(corpusDir, f.File))
+	require.NoError(t, err, "%s is listed in the manifest", f.File)
+	sum := sha256.Sum256(data)
+	require.Equal(t, f.SHA256, hex.EncodeToString(sum[:]), f.File)
+	return data
+}
+
+// values calls cb with every value of the spans
+func (f corpusFixture) values(t *testing.T, cb func(v uint64)) {
+	parse := func(s string) uint64 {
+		v, err := strconv.ParseUint(s, 10, 64)
+		require.NoError(t, err)
+		return v
+	}
+	for _, s := range f.Spans {
+		first, last, step := parse(s.First), parse(s.Last), parse(s.Step)
+		require.True(t, step > 0 && first <= last, f.Name)
+		for v := first; ; v += step {
+			cb(v)
+			if last-v < step {
+				break
+			}
+		}
+	}
+}
+
+// expected builds the fixture contents with the values placed in every one of the high keys,
+// keys is nil for 64-bit fixtures
+func (f corpusFixture) expected(t *testing.T, keys []uint32) *BTreemap {
+	tm := New()
+	f.values(t, func(v uint64) {
+		if keys == nil {
+			tm.Add(v)
+			return
+		}
+		for _, hi := range keys {
+			tm.Add(joinHiLo(hi, uint32(v)))
+		}
+	})
+	if f.RunOptimize {
+		tm.RunOptimize()
+	}
+	return tm
+}
+
+// envelope wraps a 32-bit bitmap written by another implementation into the 64-bit layout of the format,
+// once per high key
+func envelope(format Format, keys []uint32, payload []byte) []byte {
+	var buf bytes.Buffer
+	var header [8]byte
+	if format == FormatJvm {
+		binary.BigEndian.PutUint32(header[1:], uint32(len(keys)))
+		buf.Write(header[:5])
+	} else {
+		binary.LittleEndian.PutUint64(header[:], uint64(len(keys)))
+		buf.Write(header[:])
+	}
+	for _, hi := range keys {
+		format.byteOrder().PutUint32(header[:4], hi)
+		buf.Write(header[:4])
+		buf.Write(payload)
+	}
+	return buf.Bytes()
+}
+
+// checkInterop reads data written by another implementation and,
+// when the bytes are reproducible, writes the same contents and compares
+func checkInterop(t *testing.T, format Format, signed bool, data []byte, expected *BTreemap, exact bool) {
+	detected, err := DetectFormat(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, format, detected)
+
+	tm := New().WithFormat(format)
+	n, err := tm.ReadFrom(bytes.NewReader(data))
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), n)
+	require.True(t, expected.Equals(tm))
+
+	validated := New().WithFormat(format)
+	n, err = validated.FromBufferWithOptions(data, ReadOptions{})
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), n)
+	require.True(t, expected.Equals(validated))
+	require.NoError(t, validated.Validate())
+
+	for _, read := range []*BTreemap{tm, validated} {
+		written, err := read.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, data, written, "a bitmap read from the fixture writes it back unchanged")
+	}
+
+	if exact {
+		expected.WithFormat(format)
+		if signed {
+			expected.WithJvmSignedSerializer()
+		}
+		written, err := expected.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, data, written)
+	}
+}
+
+// TestCorpus_Interop checks the package against files written by CRoaring and Java RoaringBitmap,
+// see _data/README.md for where they come from
+func TestCorpus_Interop(t *testing.T) {
+	for _, f := range readCorpus(t) {
+		f := f
+		t.Run(f.Name, func(t *testing.T) {
+			data := f.read(t)
+			switch f.Format {
+			case "cpp":
+				checkInterop(t, FormatCpp, false, data, f.expected(t, nil), f.ExactBytes)
+			case "jvm":
+				checkInterop(t, FormatJvm, f.SignedLongs, data, f.expected(t, nil), f.ExactBytes)
+			case "portable32":
+				keys := []uint32{0, 1, 1 << 31, math.MaxUint32}
+				for _, format := range []Format{FormatCpp, FormatJvm} {
+					checkInterop(t, format, false, envelope(format, keys, data), f.expected(t, keys), f.ExactBytes)
+				}
+			default:
+				require.Failf(t, "unknown format in manifest", "%q", f.Format)
+			}
+		})
+	}
+}
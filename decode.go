@@ -0,0 +1,161 @@
+package roaring64
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tidwall/btree"
+)
+
+var (
+	// ErrCorrupt is the cause of a DecodeError for malformed input
+	ErrCorrupt = errors.New("corrupt bitmap")
+	// ErrLimitExceeded is the cause of a DecodeError for input that exceeds the configured ReadOptions
+	ErrLimitExceeded = errors.New("limit exceeded")
+)
+
+// DecodeError describes why and where validating deserialization failed.
+// Use errors.Is with ErrCorrupt or ErrLimitExceeded to classify it.
+type DecodeError struct {
+	// Offset is the position in the stream of the header, key or bitmap that failed
+	Offset int64
+	Reason string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", e.Err, e.Offset, e.Reason)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func corruptAt(offset int64, format string, args ...interface{}) error {
+	return &DecodeError{Offset: offset, Reason: fmt.Sprintf(format, args...), Err: ErrCorrupt}
+}
+
+func limitAt(offset int64, format string, args ...interface{}) error {
+	return &DecodeError{Offset: offset, Reason: fmt.Sprintf(format, args...), Err: ErrLimitExceeded}
+}
+
+// ReadOptions bounds the resources validating deserialization may use.
+// A zero value means no limit.
+type ReadOptions struct {
+	MaxKeys        uint64
+	MaxBytes       int64
+	MaxCardinality uint64
+}
+
+type limitedReader struct {
+	r        io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.max > 0 {
+		left := l.max - l.n
+		if left <= 0 {
+			l.exceeded = true
+			return 0, ErrLimitExceeded
+		}
+		if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+// ReadFromWithOptions deserializes untrusted input in the format of the configured serializer,
+// a jvm serializer accepts both values of the signed-longs flag and keeps the one it found.
+// Unlike ReadFrom it checks that high keys are strictly increasing, that every container is well formed
+// and that the input stays within the given limits. Failures are reported as a *DecodeError
+// and leave the bitmap untouched.
+func (tm *BTreemap) ReadFromWithOptions(r io.Reader, opts ReadOptions) (int64, error) {
+	tree, signed, n, err := decodeTree(r, tm.serializer.format(), opts)
+	if err != nil {
+		return n, err
+	}
+	tm.tree = tree
+	if j, ok := tm.serializer.(*jvmSerializer); ok {
+		j.signed = signed
+	}
+	return n, nil
+}
+
+// FromBufferWithOptions is like ReadFromWithOptions for a byte slice
+func (tm *BTreemap) FromBufferWithOptions(buf []byte, opts ReadOptions) (int64, error) {
+	if opts.MaxBytes > 0 && int64(len(buf)) > opts.MaxBytes {
+		return 0, limitAt(opts.MaxBytes, "input has %d bytes, at most %d are allowed", len(buf), opts.MaxBytes)
+	}
+	return tm.ReadFromWithOptions(bytes.NewReader(buf), opts)
+}
+
+func decodeTree(r io.Reader, format Format, opts ReadOptions) (tree *btree.BTree, signed bool, n int64, err error) {
+	lr := &limitedReader{r: r, max: opts.MaxBytes}
+	defer func() {
+		// the 32-bit decoder can panic on inconsistent container headers
+		if rec := recover(); rec != nil {
+			tree, signed, n, err = nil, false, lr.n, corruptAt(lr.n, "%v", rec)
+		}
+	}()
+	readErr := func(offset int64, what string, err error) error {
+		if lr.exceeded {
+			return limitAt(lr.n, "more than %d bytes", opts.MaxBytes)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return corruptAt(offset, "truncated %s", what)
+		}
+		return corruptAt(offset, "invalid %s: %v", what, err)
+	}
+
+	// the input of every bitmap is kept to check its containers on the raw bytes,
+	// walking the decoded values would cost time proportional to the claimed cardinality
+	var raw bytes.Buffer
+	sr, err := NewStreamReader(io.TeeReader(lr, &raw), format)
+	if err != nil {
+		return nil, false, lr.n, readErr(0, "header", err)
+	}
+	if opts.MaxKeys > 0 && sr.Len() > opts.MaxKeys {
+		return nil, false, lr.n, limitAt(0, "%d keys, at most %d are allowed", sr.Len(), opts.MaxKeys)
+	}
+
+	tree = btree.New(2, nil)
+	var card uint64
+	var lastKey uint32
+	for i := uint64(0); ; i++ {
+		offset := lr.n
+		raw.Reset()
+		highBits, bm, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, lr.n, readErr(offset, fmt.Sprintf("bitmap %d of %d", i, sr.Len()), err)
+		}
+		if i > 0 && !keyLess(sr.SignedLongs(), lastKey, highBits) {
+			return nil, false, lr.n, corruptAt(offset, "high key %d follows %d, keys must be strictly increasing", highBits, lastKey)
+		}
+		lastKey = highBits
+
+		// check the limit before the containers, a few run containers can claim billions of values
+		card += bm.GetCardinality()
+		if opts.MaxCardinality > 0 && card > opts.MaxCardinality {
+			return nil, false, lr.n, limitAt(offset, "more than %d values", opts.MaxCardinality)
+		}
+		if err := checkPortable(raw.Bytes()[4:]); err != nil {
+			return nil, false, lr.n, corruptAt(offset+4, "bitmap for high key %d: %v", highBits, err)
+		}
+		if bm.IsEmpty() {
+			continue
+		}
+		tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm, HighBits: highBits})
+	}
+	return tree, sr.SignedLongs(), lr.n, nil
+}
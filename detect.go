@@ -0,0 +1,82 @@
+package roaring64
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrUnknownFormat is returned when the input doesn't look like any supported serialization format
+var ErrUnknownFormat = errors.New("unknown serialization format")
+
+const (
+	serialCookieNoRunContainer = 12346
+	serialCookie               = 12347
+
+	// a non-empty bitmap in either format is at least this long, enough to reach the first cookie
+	sniffLen = 16
+)
+
+func isCookie(b []byte) bool {
+	cookie := binary.LittleEndian.Uint32(b)
+	return cookie == serialCookieNoRunContainer || cookie&0xFFFF == serialCookie
+}
+
+func sniffFormat(prefix []byte) (Format, error) {
+	// an empty cpp bitmap: 8 zero bytes
+	if len(prefix) >= 8 && binary.LittleEndian.Uint64(prefix) == 0 {
+		return FormatCpp, nil
+	}
+	// little-endian key count, a high key and the cookie of the first 32-bit bitmap
+	if len(prefix) >= 16 {
+		count := binary.LittleEndian.Uint64(prefix)
+		if count <= math.MaxUint32+1 && isCookie(prefix[12:]) {
+			return FormatCpp, nil
+		}
+	}
+	// signed-longs flag, big-endian key count, a high key and the cookie of the first 32-bit bitmap
+	if len(prefix) >= 13 && prefix[0] <= 1 && binary.BigEndian.Uint32(prefix[1:]) > 0 && isCookie(prefix[9:]) {
+		return FormatJvm, nil
+	}
+	// an empty jvm bitmap: the flag and a zero key count
+	if len(prefix) >= 5 && prefix[0] <= 1 && binary.BigEndian.Uint32(prefix[1:]) == 0 {
+		return FormatJvm, nil
+	}
+	return 0, ErrUnknownFormat
+}
+
+// DetectFormat sniffs the serialization format from the first bytes of the input.
+// Use bytes.NewReader to inspect a byte slice.
+func DetectFormat(r io.ReaderAt) (Format, error) {
+	var buf [sniffLen]byte
+	n, err := r.ReadAt(buf[:], 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return sniffFormat(buf[:n])
+}
+
+// ReadAny reads a bitmap in whatever supported format the input uses.
+// The returned bitmap keeps that format, so WriteTo writes it back the same way.
+// The format is sniffed with Peek, so nothing past the end of the bitmap is consumed
+// and further bitmaps can be read from the same reader. An empty jvm bitmap followed by three zero bytes
+// can't be told apart from an empty cpp bitmap and is read as one.
+func ReadAny(r *bufio.Reader) (*BTreemap, int64, error) {
+	prefix, err := r.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	format, err := sniffFormat(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	tm := New().WithFormat(format)
+	read, err := tm.ReadFrom(r)
+	if err != nil {
+		return nil, read, err
+	}
+	return tm, read, nil
+}
@@ -0,0 +1,291 @@
+package roaring64
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/btree"
+)
+
+// JSONEncoding selects how MarshalJSON renders a bitmap.
+// UnmarshalJSON accepts every form regardless of this setting.
+type JSONEncoding int
+
+const (
+	// JSONArray renders every value: [1,2,5,6,7]
+	JSONArray JSONEncoding = iota
+	// JSONRanges renders runs of consecutive values as inclusive [first,last] pairs: [[1,2],[5,7]]
+	JSONRanges
+	// JSONBase64 renders the base64 encoded binary form of the configured serializer
+	JSONBase64
+)
+
+// maxSafeInteger is the largest integer a JSON consumer using IEEE doubles reads back exactly,
+// larger values are written as decimal strings.
+const maxSafeInteger = 1<<53 - 1
+
+// WithJSONEncoding configures how MarshalJSON renders the bitmap
+func (tm *BTreemap) WithJSONEncoding(enc JSONEncoding) *BTreemap {
+	tm.jsonEncoding = enc
+	return tm
+}
+
+// init makes a zero value BTreemap, as created by encoding/json or encoding/gob, usable
+func (tm *BTreemap) init() {
+	if tm.tree == nil {
+		tm.tree = btree.New(2, nil)
+	}
+	if tm.serializer == nil {
+		tm.WithCppSerializer()
+	}
+}
+
+// iterateRanges calls cb with every maximal run of consecutive values as an inclusive range,
+// it walks the containers run by run so a full key costs as much as a single value
+func (tm *BTreemap) iterateRanges(cb func(first, last uint64) bool) {
+	var first, last uint64
+	started := false
+	goOn := true
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		high := uint64(bm.HighBits) << 32
+		forEachRun(bm.Bitmap, func(start, end uint32) bool {
+			if started && high|uint64(start) == last+1 {
+				last = high | uint64(end)
+				return true
+			}
+			if started {
+				if goOn = cb(first, last); !goOn {
+					return false
+				}
+			}
+			first, last, started = high|uint64(start), high|uint64(end), true
+			return true
+		})
+		return goOn
+	})
+	if started && goOn {
+		cb(first, last)
+	}
+}
+
+func appendJSONUint(dst []byte, v uint64) []byte {
+	if v > maxSafeInteger {
+		dst = append(dst, '"')
+		dst = strconv.AppendUint(dst, v, 10)
+		return append(dst, '"')
+	}
+	return strconv.AppendUint(dst, v, 10)
+}
+
+func (tm *BTreemap) MarshalJSON() ([]byte, error) {
+	switch tm.jsonEncoding {
+	case JSONBase64:
+		str, err := tm.ToBase64()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(str)
+	case JSONRanges:
+		buf := []byte{'['}
+		tm.iterateRanges(func(first, last uint64) bool {
+			if len(buf) > 1 {
+				buf = append(buf, ',')
+			}
+			buf = append(buf, '[')
+			buf = appendJSONUint(buf, first)
+			buf = append(buf, ',')
+			buf = appendJSONUint(buf, last)
+			buf = append(buf, ']')
+			return true
+		})
+		return append(buf, ']'), nil
+	default:
+		buf := []byte{'['}
+		tm.Iterate(func(x uint64) bool {
+			if len(buf) > 1 {
+				buf = append(buf, ',')
+			}
+			buf = appendJSONUint(buf, x)
+			return true
+		})
+		return append(buf, ']'), nil
+	}
+}
+
+func parseJSONUint(raw json.RawMessage) (uint64, error) {
+	str := string(bytes.TrimSpace(raw))
+	if strings.HasPrefix(str, `"`) {
+		if err := json.Unmarshal(raw, &str); err != nil {
+			return 0, err
+		}
+	}
+	return strconv.ParseUint(str, 10, 64)
+}
+
+// UnmarshalJSON accepts a base64 string in either serialization format,
+// or an array whose elements are values or inclusive [first,last] ranges.
+// Values may be JSON numbers or decimal strings.
+func (tm *BTreemap) UnmarshalJSON(data []byte) error {
+	tm.init()
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var str string
+		if err := json.Unmarshal(data, &str); err != nil {
+			return err
+		}
+		bin, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return err
+		}
+		return tm.unmarshalAny(bin)
+	}
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(data, &elems); err != nil {
+		return err
+	}
+	result := New()
+	for _, elem := range elems {
+		elem = bytes.TrimSpace(elem)
+		if len(elem) > 0 && elem[0] == '[' {
+			var bounds []json.RawMessage
+			if err := json.Unmarshal(elem, &bounds); err != nil {
+				return err
+			}
+			if len(bounds) != 2 {
+				return fmt.Errorf("a range needs exactly 2 bounds, got %s", elem)
+			}
+			first, err := parseJSONUint(bounds[0])
+			if err != nil {
+				return err
+			}
+			last, err := parseJSONUint(bounds[1])
+			if err != nil {
+				return err
+			}
+			if first > last {
+				return fmt.Errorf("invalid range %s", elem)
+			}
+			result.addRangeClosed(first, last)
+			continue
+		}
+
+		v, err := parseJSONUint(elem)
+		if err != nil {
+			return err
+		}
+		result.Add(v)
+	}
+	tm.tree = result.tree
+	return nil
+}
+
+// unmarshalAny validates binary data in either format and keeps the format for later writes
+func (tm *BTreemap) unmarshalAny(data []byte) error {
+	format, err := sniffFormat(data)
+	if err != nil {
+		return err
+	}
+	// a corrupt input leaves the bitmap and its format untouched, like Scan
+	prev := tm.serializer
+	tm.WithFormat(format)
+	if _, err := tm.FromBufferWithOptions(data, ReadOptions{}); err != nil {
+		tm.serializer = prev
+		return err
+	}
+	return nil
+}
+
+// MarshalText renders the bitmap as a set where runs of 3 or more values collapse into ranges: {1,2,5-100}
+func (tm *BTreemap) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+	tm.writeText(&buf, 0)
+	return buf.Bytes(), nil
+}
+
+// writeText writes the text form, eliding everything after limit entries when limit is positive
+func (tm *BTreemap) writeText(buf *bytes.Buffer, limit int) {
+	buf.WriteByte('{')
+	counter := 0
+	tm.iterateRanges(func(first, last uint64) bool {
+		for _, item := range textItems(first, last) {
+			if counter > 0 {
+				buf.WriteByte(',')
+			}
+			counter++
+			if limit > 0 && counter > limit {
+				buf.WriteString("...")
+				return false
+			}
+			buf.WriteString(item)
+		}
+		return true
+	})
+	buf.WriteByte('}')
+}
+
+func textItems(first, last uint64) []string {
+	switch last - first {
+	case 0:
+		return []string{strconv.FormatUint(first, 10)}
+	case 1:
+		return []string{strconv.FormatUint(first, 10), strconv.FormatUint(last, 10)}
+	default:
+		return []string{strconv.FormatUint(first, 10) + "-" + strconv.FormatUint(last, 10)}
+	}
+}
+
+var errTextFormat = errors.New("invalid text bitmap, expected something like {1,2,5-100}")
+
+// UnmarshalText parses the form written by MarshalText, the braces are optional
+func (tm *BTreemap) UnmarshalText(text []byte) error {
+	tm.init()
+	str := strings.TrimSpace(string(text))
+	if strings.HasPrefix(str, "{") != strings.HasSuffix(str, "}") {
+		return errTextFormat
+	}
+	str = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(str, "{"), "}"))
+
+	result := New()
+	if str != "" {
+		for _, item := range strings.Split(str, ",") {
+			item = strings.TrimSpace(item)
+			bounds := strings.SplitN(item, "-", 2)
+			first, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%v: %v", errTextFormat, err)
+			}
+			last := first
+			if len(bounds) == 2 {
+				if last, err = strconv.ParseUint(strings.TrimSpace(bounds[1]), 10, 64); err != nil {
+					return fmt.Errorf("%v: %v", errTextFormat, err)
+				}
+			}
+			if first > last {
+				return fmt.Errorf("%v: invalid range %q", errTextFormat, item)
+			}
+			result.addRangeClosed(first, last)
+		}
+	}
+	tm.tree = result.tree
+	return nil
+}
+
+func (tm *BTreemap) GobEncode() ([]byte, error) {
+	return tm.MarshalBinary()
+}
+
+// GobDecode accepts the binary form in either serialization format
+func (tm *BTreemap) GobDecode(data []byte) error {
+	tm.init()
+	return tm.unmarshalAny(data)
+}
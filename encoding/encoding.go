@@ -0,0 +1,118 @@
+// Package encoding maps ordered types onto uint64 so that the encoded values sort the same way
+// as the originals. A roaring64.BTreemap of encoded values then answers range queries over
+// timestamps, float scores, signed ids and composite keys with its ordinary range and iterator APIs.
+//
+// The typed sets in this package wrap a BTreemap and do the encoding for you.
+package encoding
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const signBit = 1 << 63
+
+// EncodeInt64 flips the sign bit, so negative values sort before positive ones
+func EncodeInt64(v int64) uint64 {
+	return uint64(v) ^ signBit
+}
+
+// DecodeInt64 is the inverse of EncodeInt64
+func DecodeInt64(u uint64) int64 {
+	return int64(u ^ signBit)
+}
+
+// canonicalNaN is where every NaN ends up, above +Inf
+var canonicalNaN = math.Float64bits(math.NaN()) | signBit
+
+// EncodeFloat64 maps the IEEE 754 bits of f so that they sort like the floats do:
+// positive values get the sign bit set, negative values get all their bits flipped.
+// -0 encodes like +0 and every NaN encodes to a single value that sorts after +Inf.
+func EncodeFloat64(f float64) uint64 {
+	if f != f {
+		return canonicalNaN
+	}
+	if f == 0 {
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits&signBit != 0 {
+		return ^bits
+	}
+	return bits | signBit
+}
+
+// DecodeFloat64 is the inverse of EncodeFloat64
+func DecodeFloat64(u uint64) float64 {
+	if u&signBit != 0 {
+		return math.Float64frombits(u &^ signBit)
+	}
+	return math.Float64frombits(^u)
+}
+
+// EncodePair puts hi in the high 32 bits, so all pairs sharing hi land in the same BTreemap key
+func EncodePair(hi, lo uint32) uint64 {
+	return uint64(hi)<<32 | uint64(lo)
+}
+
+// DecodePair is the inverse of EncodePair
+func DecodePair(u uint64) (hi, lo uint32) {
+	return uint32(u >> 32), uint32(u)
+}
+
+// TimeEncoding maps times to uint64 at a fixed precision. A time is truncated toward the past
+// to a multiple of the precision since the Unix epoch, so times within the same tick encode alike.
+type TimeEncoding struct {
+	precision time.Duration
+}
+
+// NewTimeEncoding accepts a precision that divides a second, like time.Millisecond,
+// or a whole number of seconds, like time.Hour.
+// With a sub-second precision only times whose tick count fits an int64 can be encoded,
+// for time.Nanosecond that's the years 1678 to 2262, just like time.Time.UnixNano.
+func NewTimeEncoding(precision time.Duration) (TimeEncoding, error) {
+	if precision <= 0 ||
+		(precision < time.Second && time.Second%precision != 0) ||
+		(precision > time.Second && precision%time.Second != 0) {
+		return TimeEncoding{}, fmt.Errorf("precision %v must divide a second or be a whole number of seconds", precision)
+	}
+	return TimeEncoding{precision: precision}, nil
+}
+
+// Precision returns the precision the encoding truncates to
+func (e TimeEncoding) Precision() time.Duration {
+	return e.precision
+}
+
+// Encode truncates t to the precision, the location of t doesn't matter
+func (e TimeEncoding) Encode(t time.Time) uint64 {
+	return EncodeInt64(e.ticks(t))
+}
+
+func (e TimeEncoding) ticks(t time.Time) int64 {
+	if e.precision >= time.Second {
+		return floorDiv(t.Unix(), int64(e.precision/time.Second))
+	}
+	perSecond := int64(time.Second / e.precision)
+	return t.Unix()*perSecond + int64(t.Nanosecond())/int64(e.precision)
+}
+
+// Decode returns the start of the tick in UTC
+func (e TimeEncoding) Decode(u uint64) time.Time {
+	ticks := DecodeInt64(u)
+	if e.precision >= time.Second {
+		return time.Unix(ticks*int64(e.precision/time.Second), 0).UTC()
+	}
+	perSecond := int64(time.Second / e.precision)
+	sec := floorDiv(ticks, perSecond)
+	return time.Unix(sec, (ticks-sec*perSecond)*int64(e.precision)).UTC()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
@@ -0,0 +1,245 @@
+package encoding
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeInt64(t *testing.T) {
+	values := []int64{math.MinInt64, math.MinInt64 + 1, -1 << 32, -2, -1, 0, 1, 2, 1 << 32, math.MaxInt64 - 1, math.MaxInt64}
+	rng := rand.New(rand.NewSource(37))
+	for i := 0; i < 1000; i++ {
+		values = append(values, int64(rng.Uint64()))
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	for i, v := range values {
+		require.Equal(t, v, DecodeInt64(EncodeInt64(v)))
+		if i > 0 && values[i-1] < v {
+			require.Less(t, EncodeInt64(values[i-1]), EncodeInt64(v))
+		}
+	}
+	require.EqualValues(t, 0, EncodeInt64(math.MinInt64))
+	require.EqualValues(t, uint64(math.MaxUint64), EncodeInt64(math.MaxInt64))
+}
+
+func TestEncodeFloat64(t *testing.T) {
+	values := []float64{
+		math.Inf(-1), -math.MaxFloat64, -1e300, -1, -math.SmallestNonzeroFloat64, 0,
+		math.SmallestNonzeroFloat64, 1e-300, 0.5, 1, math.Nextafter(1, 2), 1e300, math.MaxFloat64, math.Inf(1),
+	}
+	rng := rand.New(rand.NewSource(37))
+	for i := 0; i < 1000; i++ {
+		values = append(values, rng.NormFloat64()*math.Pow(10, float64(rng.Intn(600)-300)))
+	}
+	sort.Float64s(values)
+
+	for i, v := range values {
+		require.Equal(t, v, DecodeFloat64(EncodeFloat64(v)))
+		if i > 0 && values[i-1] < v {
+			require.Less(t, EncodeFloat64(values[i-1]), EncodeFloat64(v))
+		}
+	}
+
+	require.Equal(t, EncodeFloat64(0), EncodeFloat64(math.Copysign(0, -1)))
+	require.Equal(t, EncodeFloat64(math.NaN()), EncodeFloat64(-math.NaN()))
+	require.Greater(t, EncodeFloat64(math.NaN()), EncodeFloat64(math.Inf(1)))
+	require.True(t, math.IsNaN(DecodeFloat64(EncodeFloat64(math.NaN()))))
+}
+
+func TestEncodePair(t *testing.T) {
+	require.Less(t, EncodePair(1, math.MaxUint32), EncodePair(2, 0))
+	require.Less(t, EncodePair(2, 0), EncodePair(2, 1))
+	hi, lo := DecodePair(EncodePair(7, 9))
+	require.EqualValues(t, 7, hi)
+	require.EqualValues(t, 9, lo)
+}
+
+func TestTimeEncoding(t *testing.T) {
+	for _, precision := range []time.Duration{0, -time.Second, 7 * time.Millisecond, 1500 * time.Millisecond} {
+		_, err := NewTimeEncoding(precision)
+		require.Error(t, err, precision)
+	}
+
+	base := time.Date(2021, 3, 4, 5, 6, 7, 891234567, time.FixedZone("x", 3600))
+	for _, precision := range []time.Duration{time.Nanosecond, time.Microsecond, time.Millisecond, time.Second, time.Minute, time.Hour, 24 * time.Hour} {
+		enc, err := NewTimeEncoding(precision)
+		require.NoError(t, err)
+		require.Equal(t, precision, enc.Precision())
+
+		for _, tm := range []time.Time{base, base.Add(-60 * 365 * 24 * time.Hour), time.Unix(0, 0), time.Unix(-1, 1)} {
+			decoded := enc.Decode(enc.Encode(tm))
+			require.Equal(t, time.UTC, decoded.Location())
+			require.True(t, decoded.Equal(tm.Truncate(precision)), "%v %v", precision, tm)
+			require.False(t, decoded.After(tm))
+			require.True(t, tm.Sub(decoded) < precision)
+			require.Equal(t, enc.Encode(tm), enc.Encode(decoded))
+
+			require.Less(t, enc.Encode(tm), enc.Encode(tm.Add(precision)))
+			require.LessOrEqual(t, enc.Encode(tm.Add(-1)), enc.Encode(tm))
+		}
+	}
+
+	enc, err := NewTimeEncoding(time.Second)
+	require.NoError(t, err)
+	old := time.Date(-5000, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.True(t, old.Equal(enc.Decode(enc.Encode(old))))
+	require.Less(t, enc.Encode(old), enc.Encode(time.Unix(0, 0)))
+}
+
+func TestInt64Set(t *testing.T) {
+	s := NewInt64Set(-5, 3, math.MinInt64, math.MaxInt64)
+	require.True(t, s.Contains(-5))
+	require.False(t, s.Contains(5))
+	s.AddRange(-3, 2)
+	require.EqualValues(t, 9, s.Cardinality())
+	require.EqualValues(t, 5, s.CountRange(-5, 1))
+	require.EqualValues(t, 0, s.CountRange(1, -5))
+
+	var got []int64
+	s.Range(-4, 3, func(v int64) bool {
+		got = append(got, v)
+		return true
+	})
+	require.Equal(t, []int64{-3, -2, -1, 0, 1}, got)
+
+	got = nil
+	s.Iterate(func(v int64) bool {
+		got = append(got, v)
+		return len(got) < 3
+	})
+	require.Equal(t, []int64{math.MinInt64, -5, -3}, got)
+
+	min, ok := s.Min()
+	require.True(t, ok)
+	require.EqualValues(t, math.MinInt64, min)
+	max, ok := s.Max()
+	require.True(t, ok)
+	require.EqualValues(t, math.MaxInt64, max)
+
+	s.RemoveRange(math.MinInt64, 0)
+	s.Remove(math.MaxInt64)
+	require.EqualValues(t, 3, s.Cardinality())
+	min, _ = s.Min()
+	require.EqualValues(t, 0, min)
+
+	_, ok = NewInt64Set().Min()
+	require.False(t, ok)
+}
+
+func TestFloat64Set(t *testing.T) {
+	s := NewFloat64Set(-2.5, -0.0, 1e-10, 3.25, math.Inf(1), math.NaN())
+	require.True(t, s.Contains(0))
+	require.True(t, s.Contains(math.NaN()))
+	require.EqualValues(t, 6, s.Cardinality())
+
+	var got []float64
+	s.Range(-3, 3.25, func(v float64) bool {
+		got = append(got, v)
+		return true
+	})
+	require.Equal(t, []float64{-2.5, 0, 1e-10}, got)
+	require.EqualValues(t, 4, s.CountRange(math.Inf(-1), math.Inf(1)))
+
+	max, ok := s.Max()
+	require.True(t, ok)
+	require.True(t, math.IsNaN(max))
+
+	s.RemoveRange(-1, 1)
+	s.Remove(math.NaN())
+	got = nil
+	s.Iterate(func(v float64) bool {
+		got = append(got, v)
+		return true
+	})
+	require.Equal(t, []float64{-2.5, 3.25, math.Inf(1)}, got)
+	min, _ := s.Min()
+	require.Equal(t, -2.5, min)
+
+	// the floats next to 1 are one encoded value apart
+	above := math.Nextafter(math.Nextafter(1, 2), 2)
+	s.AddRange(1, math.Nextafter(above, 2))
+	require.EqualValues(t, 3, s.CountRange(1, 2))
+	require.True(t, s.Contains(above))
+	s.AddRange(2, 1)
+	require.EqualValues(t, 6, s.Cardinality())
+}
+
+func TestTimeSet(t *testing.T) {
+	_, err := NewTimeSet(0)
+	require.Error(t, err)
+
+	s, err := NewTimeSet(time.Minute)
+	require.NoError(t, err)
+	start := time.Date(2021, 1, 1, 12, 0, 30, 0, time.UTC)
+	s.AddRange(start, start.Add(time.Hour))
+	require.EqualValues(t, 60, s.Cardinality())
+	require.True(t, s.Contains(start.Add(59*time.Minute+29*time.Second)))
+	require.False(t, s.Contains(start.Add(60*time.Minute)))
+	require.False(t, s.Contains(start.Add(-time.Minute)))
+
+	s.Add(start.Add(-24 * time.Hour))
+	s.RemoveRange(start.Add(10*time.Minute), start.Add(50*time.Minute))
+	require.EqualValues(t, 21, s.Cardinality())
+	require.EqualValues(t, 10, s.CountRange(start, start.Add(30*time.Minute)))
+
+	var got []time.Time
+	s.Range(start.Add(48*time.Minute), start.Add(53*time.Minute), func(tm time.Time) bool {
+		got = append(got, tm)
+		return true
+	})
+	require.Equal(t, []time.Time{
+		time.Date(2021, 1, 1, 12, 50, 0, 0, time.UTC),
+		time.Date(2021, 1, 1, 12, 51, 0, 0, time.UTC),
+		time.Date(2021, 1, 1, 12, 52, 0, 0, time.UTC),
+	}, got)
+
+	min, ok := s.Min()
+	require.True(t, ok)
+	require.Equal(t, time.Date(2020, 12, 31, 12, 0, 0, 0, time.UTC), min)
+	max, _ := s.Max()
+	require.Equal(t, time.Date(2021, 1, 1, 12, 59, 0, 0, time.UTC), max)
+
+	n := 0
+	s.Iterate(func(time.Time) bool {
+		n++
+		return n < 5
+	})
+	require.Equal(t, 5, n)
+}
+
+func TestPairSet(t *testing.T) {
+	s := NewPairSet(Pair{1, 5}, Pair{2, 0}, Pair{math.MaxUint32, math.MaxUint32})
+	require.True(t, s.Contains(1, 5))
+	require.False(t, s.Contains(5, 1))
+	s.AddRange(Pair{1, math.MaxUint32 - 1}, Pair{2, 2})
+	require.EqualValues(t, 6, s.Cardinality())
+	require.EqualValues(t, 3, s.CountRange(Pair{1, 6}, Pair{2, 1}))
+
+	var got []Pair
+	s.Range(Pair{1, 6}, Pair{3, 0}, func(p Pair) bool {
+		got = append(got, p)
+		return true
+	})
+	require.Equal(t, []Pair{{1, math.MaxUint32 - 1}, {1, math.MaxUint32}, {2, 0}, {2, 1}}, got)
+
+	s.RemoveRange(Pair{2, 0}, Pair{3, 0})
+	s.Remove(1, 5)
+	got = nil
+	s.Iterate(func(p Pair) bool {
+		got = append(got, p)
+		return true
+	})
+	require.Equal(t, []Pair{{1, math.MaxUint32 - 1}, {1, math.MaxUint32}, {math.MaxUint32, math.MaxUint32}}, got)
+
+	min, ok := s.Min()
+	require.True(t, ok)
+	require.Equal(t, Pair{1, math.MaxUint32 - 1}, min)
+	max, _ := s.Max()
+	require.Equal(t, Pair{math.MaxUint32, math.MaxUint32}, max)
+}
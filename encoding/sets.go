@@ -0,0 +1,360 @@
+package encoding
+
+import (
+	"time"
+
+	roaring64 "github.com/casualjim/go-roaring64"
+)
+
+// Ranges in this file are half-open like roaring64.BTreemap.AddRange: from is included, to is not.
+
+// iterateRange calls cb with every encoded value in [from, to) until it returns false
+func iterateRange(tm *roaring64.BTreemap, from, to uint64, cb func(uint64) bool) {
+	if from >= to {
+		return
+	}
+	it := tm.Iterator()
+	it.AdvanceIfNeeded(from)
+	for it.HasNext() {
+		v := it.Next()
+		if v >= to || !cb(v) {
+			return
+		}
+	}
+}
+
+// countRange returns the number of encoded values in [from, to)
+func countRange(tm *roaring64.BTreemap, from, to uint64) uint64 {
+	if from >= to {
+		return 0
+	}
+	n := tm.Rank(to - 1)
+	if from > 0 {
+		n -= tm.Rank(from - 1)
+	}
+	return n
+}
+
+// Int64Set is a set of int64 stored in a BTreemap
+type Int64Set struct {
+	Bitmap *roaring64.BTreemap
+}
+
+func NewInt64Set(values ...int64) *Int64Set {
+	s := &Int64Set{Bitmap: roaring64.New()}
+	for _, v := range values {
+		s.Add(v)
+	}
+	return s
+}
+
+func (s *Int64Set) Add(v int64) {
+	s.Bitmap.Add(EncodeInt64(v))
+}
+
+func (s *Int64Set) Remove(v int64) {
+	s.Bitmap.Remove(EncodeInt64(v))
+}
+
+func (s *Int64Set) Contains(v int64) bool {
+	return s.Bitmap.Contains(EncodeInt64(v))
+}
+
+func (s *Int64Set) AddRange(from, to int64) {
+	if from < to {
+		s.Bitmap.AddRange(EncodeInt64(from), EncodeInt64(to))
+	}
+}
+
+func (s *Int64Set) RemoveRange(from, to int64) {
+	if from < to {
+		s.Bitmap.RemoveRange(EncodeInt64(from), EncodeInt64(to))
+	}
+}
+
+func (s *Int64Set) CountRange(from, to int64) uint64 {
+	return countRange(s.Bitmap, EncodeInt64(from), EncodeInt64(to))
+}
+
+// Range calls cb in ascending order with every value in [from, to) until it returns false
+func (s *Int64Set) Range(from, to int64, cb func(int64) bool) {
+	iterateRange(s.Bitmap, EncodeInt64(from), EncodeInt64(to), func(u uint64) bool {
+		return cb(DecodeInt64(u))
+	})
+}
+
+// Iterate calls cb in ascending order with every value until it returns false
+func (s *Int64Set) Iterate(cb func(int64) bool) {
+	s.Bitmap.Iterate(func(u uint64) bool {
+		return cb(DecodeInt64(u))
+	})
+}
+
+func (s *Int64Set) Cardinality() uint64 {
+	return s.Bitmap.GetCardinality()
+}
+
+// Min returns the smallest value, ok is false when the set is empty
+func (s *Int64Set) Min() (v int64, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return 0, false
+	}
+	return DecodeInt64(s.Bitmap.Minimum()), true
+}
+
+// Max returns the largest value, ok is false when the set is empty
+func (s *Int64Set) Max() (v int64, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return 0, false
+	}
+	return DecodeInt64(s.Bitmap.Maximum()), true
+}
+
+// Float64Set is a set of float64 stored in a BTreemap, see EncodeFloat64 for how -0 and NaN are treated
+type Float64Set struct {
+	Bitmap *roaring64.BTreemap
+}
+
+func NewFloat64Set(values ...float64) *Float64Set {
+	s := &Float64Set{Bitmap: roaring64.New()}
+	for _, v := range values {
+		s.Add(v)
+	}
+	return s
+}
+
+func (s *Float64Set) Add(v float64) {
+	s.Bitmap.Add(EncodeFloat64(v))
+}
+
+func (s *Float64Set) Remove(v float64) {
+	s.Bitmap.Remove(EncodeFloat64(v))
+}
+
+func (s *Float64Set) Contains(v float64) bool {
+	return s.Bitmap.Contains(EncodeFloat64(v))
+}
+
+// AddRange adds every representable float64 from up to, but not including, to.
+// Wide ranges hold a huge number of floats, [1, 2) alone is 2^52 of them.
+func (s *Float64Set) AddRange(from, to float64) {
+	start, end := EncodeFloat64(from), EncodeFloat64(to)
+	if start < end {
+		s.Bitmap.AddRange(start, end)
+	}
+}
+
+func (s *Float64Set) RemoveRange(from, to float64) {
+	start, end := EncodeFloat64(from), EncodeFloat64(to)
+	if start < end {
+		s.Bitmap.RemoveRange(start, end)
+	}
+}
+
+func (s *Float64Set) CountRange(from, to float64) uint64 {
+	return countRange(s.Bitmap, EncodeFloat64(from), EncodeFloat64(to))
+}
+
+// Range calls cb in ascending order with every value in [from, to) until it returns false
+func (s *Float64Set) Range(from, to float64, cb func(float64) bool) {
+	iterateRange(s.Bitmap, EncodeFloat64(from), EncodeFloat64(to), func(u uint64) bool {
+		return cb(DecodeFloat64(u))
+	})
+}
+
+// Iterate calls cb in ascending order with every value until it returns false, NaN comes last
+func (s *Float64Set) Iterate(cb func(float64) bool) {
+	s.Bitmap.Iterate(func(u uint64) bool {
+		return cb(DecodeFloat64(u))
+	})
+}
+
+func (s *Float64Set) Cardinality() uint64 {
+	return s.Bitmap.GetCardinality()
+}
+
+// Min returns the smallest value, ok is false when the set is empty
+func (s *Float64Set) Min() (v float64, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return 0, false
+	}
+	return DecodeFloat64(s.Bitmap.Minimum()), true
+}
+
+// Max returns the largest value, ok is false when the set is empty
+func (s *Float64Set) Max() (v float64, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return 0, false
+	}
+	return DecodeFloat64(s.Bitmap.Maximum()), true
+}
+
+// TimeSet is a set of times stored in a BTreemap at the precision of its encoding.
+// Times are truncated on the way in and come back in UTC.
+type TimeSet struct {
+	Bitmap   *roaring64.BTreemap
+	Encoding TimeEncoding
+}
+
+func NewTimeSet(precision time.Duration) (*TimeSet, error) {
+	enc, err := NewTimeEncoding(precision)
+	if err != nil {
+		return nil, err
+	}
+	return &TimeSet{Bitmap: roaring64.New(), Encoding: enc}, nil
+}
+
+func (s *TimeSet) Add(t time.Time) {
+	s.Bitmap.Add(s.Encoding.Encode(t))
+}
+
+func (s *TimeSet) Remove(t time.Time) {
+	s.Bitmap.Remove(s.Encoding.Encode(t))
+}
+
+// Contains reports whether a time in the same tick as t was added
+func (s *TimeSet) Contains(t time.Time) bool {
+	return s.Bitmap.Contains(s.Encoding.Encode(t))
+}
+
+// AddRange adds every tick from the one holding from up to, but not including, the one holding to
+func (s *TimeSet) AddRange(from, to time.Time) {
+	start, end := s.Encoding.Encode(from), s.Encoding.Encode(to)
+	if start < end {
+		s.Bitmap.AddRange(start, end)
+	}
+}
+
+func (s *TimeSet) RemoveRange(from, to time.Time) {
+	start, end := s.Encoding.Encode(from), s.Encoding.Encode(to)
+	if start < end {
+		s.Bitmap.RemoveRange(start, end)
+	}
+}
+
+func (s *TimeSet) CountRange(from, to time.Time) uint64 {
+	return countRange(s.Bitmap, s.Encoding.Encode(from), s.Encoding.Encode(to))
+}
+
+// Range calls cb in ascending order with every tick in [from, to) until it returns false
+func (s *TimeSet) Range(from, to time.Time, cb func(time.Time) bool) {
+	iterateRange(s.Bitmap, s.Encoding.Encode(from), s.Encoding.Encode(to), func(u uint64) bool {
+		return cb(s.Encoding.Decode(u))
+	})
+}
+
+// Iterate calls cb in ascending order with every tick until it returns false
+func (s *TimeSet) Iterate(cb func(time.Time) bool) {
+	s.Bitmap.Iterate(func(u uint64) bool {
+		return cb(s.Encoding.Decode(u))
+	})
+}
+
+func (s *TimeSet) Cardinality() uint64 {
+	return s.Bitmap.GetCardinality()
+}
+
+// Min returns the earliest tick, ok is false when the set is empty
+func (s *TimeSet) Min() (t time.Time, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return time.Time{}, false
+	}
+	return s.Encoding.Decode(s.Bitmap.Minimum()), true
+}
+
+// Max returns the latest tick, ok is false when the set is empty
+func (s *TimeSet) Max() (t time.Time, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return time.Time{}, false
+	}
+	return s.Encoding.Decode(s.Bitmap.Maximum()), true
+}
+
+// Pair is a composite id like (tenant, local id), ordered by Hi first
+type Pair struct {
+	Hi, Lo uint32
+}
+
+func (p Pair) encode() uint64 {
+	return EncodePair(p.Hi, p.Lo)
+}
+
+// PairSet is a set of (uint32, uint32) pairs stored in a BTreemap, every Hi gets its own 32-bit bitmap
+type PairSet struct {
+	Bitmap *roaring64.BTreemap
+}
+
+func NewPairSet(pairs ...Pair) *PairSet {
+	s := &PairSet{Bitmap: roaring64.New()}
+	for _, p := range pairs {
+		s.Add(p.Hi, p.Lo)
+	}
+	return s
+}
+
+func (s *PairSet) Add(hi, lo uint32) {
+	s.Bitmap.Add(EncodePair(hi, lo))
+}
+
+func (s *PairSet) Remove(hi, lo uint32) {
+	s.Bitmap.Remove(EncodePair(hi, lo))
+}
+
+func (s *PairSet) Contains(hi, lo uint32) bool {
+	return s.Bitmap.Contains(EncodePair(hi, lo))
+}
+
+// AddRange adds every pair from up to, but not including, to in pair order
+func (s *PairSet) AddRange(from, to Pair) {
+	if start, end := from.encode(), to.encode(); start < end {
+		s.Bitmap.AddRange(start, end)
+	}
+}
+
+func (s *PairSet) RemoveRange(from, to Pair) {
+	if start, end := from.encode(), to.encode(); start < end {
+		s.Bitmap.RemoveRange(start, end)
+	}
+}
+
+func (s *PairSet) CountRange(from, to Pair) uint64 {
+	return countRange(s.Bitmap, from.encode(), to.encode())
+}
+
+// Range calls cb in ascending order with every pair in [from, to) until it returns false
+func (s *PairSet) Range(from, to Pair, cb func(Pair) bool) {
+	iterateRange(s.Bitmap, from.encode(), to.encode(), func(u uint64) bool {
+		hi, lo := DecodePair(u)
+		return cb(Pair{Hi: hi, Lo: lo})
+	})
+}
+
+// Iterate calls cb in ascending order with every pair until it returns false
+func (s *PairSet) Iterate(cb func(Pair) bool) {
+	s.Bitmap.Iterate(func(u uint64) bool {
+		hi, lo := DecodePair(u)
+		return cb(Pair{Hi: hi, Lo: lo})
+	})
+}
+
+func (s *PairSet) Cardinality() uint64 {
+	return s.Bitmap.GetCardinality()
+}
+
+// Min returns the smallest pair, ok is false when the set is empty
+func (s *PairSet) Min() (p Pair, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return Pair{}, false
+	}
+	hi, lo := DecodePair(s.Bitmap.Minimum())
+	return Pair{Hi: hi, Lo: lo}, true
+}
+
+// Max returns the largest pair, ok is false when the set is empty
+func (s *PairSet) Max() (p Pair, ok bool) {
+	if s.Bitmap.IsEmpty() {
+		return Pair{}, false
+	}
+	hi, lo := DecodePair(s.Bitmap.Maximum())
+	return Pair{Hi: hi, Lo: lo}, true
+}
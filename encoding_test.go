@@ -0,0 +1,163 @@
+package roaring64
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTreemap_MarshalJSON(t *testing.T) {
+	tm := New(1, 2, 5, 6, 7, 1<<53, math.MaxUint64)
+
+	data, err := json.Marshal(tm)
+	require.NoError(t, err)
+	require.Equal(t, `[1,2,5,6,7,"9007199254740992","18446744073709551615"]`, string(data))
+
+	data, err = json.Marshal(tm.WithJSONEncoding(JSONRanges))
+	require.NoError(t, err)
+	require.Equal(t, `[[1,2],[5,7],["9007199254740992","9007199254740992"],["18446744073709551615","18446744073709551615"]]`, string(data))
+
+	data, err = json.Marshal(New().WithJSONEncoding(JSONRanges))
+	require.NoError(t, err)
+	require.Equal(t, `[]`, string(data))
+
+	actual := New()
+	require.NoError(t, json.Unmarshal([]byte(`[1, "2", [5, "7"], ["18446744073709551614", "18446744073709551615"]]`), actual))
+	require.Equal(t, []uint64{1, 2, 5, 6, 7, math.MaxUint64 - 1, math.MaxUint64}, actual.ToArray())
+
+	require.Error(t, json.Unmarshal([]byte(`[-1]`), New()))
+	require.Error(t, json.Unmarshal([]byte(`[1.5]`), New()))
+	require.Error(t, json.Unmarshal([]byte(`[[3,1]]`), New()))
+	require.Error(t, json.Unmarshal([]byte(`[[3]]`), New()))
+}
+
+func TestTreemap_JSONRoundTrip(t *testing.T) {
+	type doc struct {
+		IDs  *BTreemap `json:"ids"`
+		None *BTreemap `json:"none"`
+	}
+
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 50; i++ {
+		tm := randomTreemap(rng)
+		tm.Add(math.MaxUint64)
+		for _, enc := range []JSONEncoding{JSONArray, JSONRanges, JSONBase64} {
+			data, err := json.Marshal(doc{IDs: tm.WithJSONEncoding(enc)})
+			require.NoError(t, err)
+
+			var actual doc
+			require.NoError(t, json.Unmarshal(data, &actual))
+			require.Nil(t, actual.None)
+			require.True(t, tm.Equals(actual.IDs), "encoding %d", enc)
+		}
+	}
+
+	jvm := New(1, 2, math.MaxUint64).WithJvmSerializer().WithJSONEncoding(JSONBase64)
+	data, err := json.Marshal(jvm)
+	require.NoError(t, err)
+	actual := New()
+	require.NoError(t, json.Unmarshal(data, actual))
+	require.True(t, jvm.Equals(actual))
+	require.Equal(t, FormatJvm, actual.Format())
+}
+
+func TestTreemap_DecodeCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	sw, err := NewStreamWriterN(&buf, FormatCpp, 1)
+	require.NoError(t, err)
+	require.NoError(t, sw.WriteBitmap(1, roaring.BitmapOf(1, 2, 3)))
+	corrupt := buf.Bytes()
+	// header, high key, cookie, container count, key and cardinality, offset
+	values := corrupt[8+4+16:]
+	values[0], values[2] = values[2], values[0]
+
+	data, err := json.Marshal(base64.StdEncoding.EncodeToString(corrupt))
+	require.NoError(t, err)
+	actual := New(7).WithJvmSerializer()
+	err = json.Unmarshal(data, actual)
+	require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	require.Equal(t, []uint64{7}, actual.ToArray())
+	require.Equal(t, FormatJvm, actual.Format())
+
+	actual = New(7)
+	err = actual.GobDecode(corrupt)
+	require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	require.Equal(t, []uint64{7}, actual.ToArray())
+}
+
+func TestTreemap_Text(t *testing.T) {
+	tm := New(1, 2, math.MaxUint64)
+	tm.AddRange(5, 101)
+	tm.AddRange(math.MaxUint32-1, math.MaxUint32+3)
+
+	text, err := tm.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, "{1,2,5-100,4294967294-4294967297,18446744073709551615}", string(text))
+	require.Equal(t, string(text), tm.String())
+	require.Equal(t, "{}", New().String())
+
+	actual := New()
+	require.NoError(t, actual.UnmarshalText(text))
+	require.True(t, tm.Equals(actual))
+
+	require.NoError(t, actual.UnmarshalText([]byte(" 3, 7 - 9 ")))
+	require.Equal(t, []uint64{3, 7, 8, 9}, actual.ToArray())
+
+	for _, invalid := range []string{"{1,2", "{a}", "{1,,2}", "{5-1}", "{-1}"} {
+		require.Error(t, New().UnmarshalText([]byte(invalid)), invalid)
+	}
+}
+
+func TestTreemap_TextFullKeys(t *testing.T) {
+	// four full keys are walked container by container, not value by value
+	tm := New()
+	tm.AddRange(0, 1<<34)
+	tm.Add(1<<34 + 1)
+
+	text, err := tm.MarshalText()
+	require.NoError(t, err)
+	require.Equal(t, "{0-17179869183,17179869185}", string(text))
+	require.Equal(t, string(text), tm.String())
+
+	data, err := tm.WithJSONEncoding(JSONRanges).MarshalJSON()
+	require.NoError(t, err)
+	require.Equal(t, "[[0,17179869183],[17179869185,17179869185]]", string(data))
+
+	// String stops after 0x40000 entries
+	sparse := New()
+	for v := uint64(0); v < 0x50000; v++ {
+		sparse.Add(v * 3)
+	}
+	str := sparse.String()
+	require.True(t, strings.HasSuffix(str, ",...}"), str[len(str)-20:])
+	require.Equal(t, 0x40000, strings.Count(str, ","))
+}
+
+func TestTreemap_Gob(t *testing.T) {
+	type doc struct {
+		Cpp *BTreemap
+		Jvm *BTreemap
+	}
+	in := doc{
+		Cpp: New(1, 2, math.MaxUint64),
+		Jvm: New(3, math.MaxUint32).WithJvmSerializer(),
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(in))
+
+	var out doc
+	require.NoError(t, gob.NewDecoder(&buf).Decode(&out))
+	require.True(t, in.Cpp.Equals(out.Cpp))
+	require.True(t, in.Jvm.Equals(out.Jvm))
+	require.Equal(t, FormatJvm, out.Jvm.Format())
+}
@@ -0,0 +1,39 @@
+//go:build go1.18
+// +build go1.18
+
+package roaring64
+
+import (
+	"bytes"
+	"testing"
+)
+
+func fuzzSeeds(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 0, 4, 2, 2, 6, 0, 1, 1, 1, 5, 0, 1, 0, 2})
+	f.Add([]byte{6, 255, 3, 2, 2, 3, 0, 5, 255, 3, 2, 2, 3, 0, 10, 3, 0, 3, 0, 12, 13})
+	f.Add([]byte{4, 1, 2, 2, 1, 7, 6, 4, 1, 2, 2, 2, 0, 1, 9, 1, 0, 3, 5, 4, 0, 3, 0})
+	f.Add(bytes.Repeat([]byte{6, 17, 2, 3, 2, 1, 200, 5, 9, 0, 2, 1, 0}, 8))
+}
+
+func FuzzTreemap_Invariants(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p := &program{data: data}
+		tm := New()
+		for i := 0; !p.done(); i++ {
+			p.mutate(t, tm)
+			if err := tm.Validate(); err != nil {
+				t.Fatalf("after operation %d: %v", i, err)
+			}
+			if tm.IsEmpty() != (tm.tree.Len() == 0) {
+				t.Fatalf("after operation %d: IsEmpty disagrees with %d keys", i, tm.tree.Len())
+			}
+		}
+	})
+}
+
+func FuzzTreemap_Differential(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(runDifferential)
+}
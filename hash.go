@@ -0,0 +1,177 @@
+package roaring64
+
+import (
+	"encoding/binary"
+	"hash"
+	"hash/fnv"
+	"math/bits"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Hash64 returns a hash of the set of values. Equal sets hash alike no matter how their containers
+// are represented or which serializer is configured, and the result is stable across processes.
+//
+// The hash is the sum of KeyHash64 over all high keys, so after changing the values of one key
+// it can be updated by subtracting the old KeyHash64 of that key and adding the new one.
+func (tm *BTreemap) Hash64() uint64 {
+	var sum uint64
+	h := fnv.New64a()
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		sum += keyHash64(h, bm)
+		return true
+	})
+	return sum
+}
+
+// KeyHash64 returns the contribution of one high key to Hash64, 0 when the key holds no values
+func (tm *BTreemap) KeyHash64(highBits uint32) uint64 {
+	key, cleanup := makeKey(highBits)
+	defer cleanup()
+
+	bm, found := tm.get(key)
+	if !found {
+		return 0
+	}
+	return keyHash64(fnv.New64a(), bm)
+}
+
+// Hash128 is like Hash64 with a wider result, the halves are summed with carry as one 128-bit number
+func (tm *BTreemap) Hash128() [2]uint64 {
+	var sum [2]uint64
+	h := fnv.New128a()
+	var buf []byte
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		if bm.IsEmpty() {
+			return true
+		}
+		h.Reset()
+		writeCanonical(h, bm)
+		buf = h.Sum(buf[:0])
+		lo, carry := bits.Add64(sum[1], fmix64(binary.BigEndian.Uint64(buf[8:])), 0)
+		sum[0], _ = bits.Add64(sum[0], fmix64(binary.BigEndian.Uint64(buf[:8])), carry)
+		sum[1] = lo
+		return true
+	})
+	return sum
+}
+
+func keyHash64(h hash.Hash64, bm *keyedBitmap) uint64 {
+	if bm.IsEmpty() {
+		return 0
+	}
+	h.Reset()
+	writeCanonical(h, bm)
+	return fmix64(h.Sum64())
+}
+
+// writeCanonical writes the high key followed by the maximal runs of values as inclusive
+// little-endian uint32 pairs. Runs only depend on the values, not on the containers holding them.
+func writeCanonical(h hash.Hash, bm *keyedBitmap) {
+	buf := make([]byte, 4, 512)
+	binary.LittleEndian.PutUint32(buf, bm.HighBits)
+
+	var first, last uint32
+	started := false
+	flush := func() {
+		buf = append(buf, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(buf[len(buf)-8:], first)
+		binary.LittleEndian.PutUint32(buf[len(buf)-4:], last)
+		if len(buf)+8 > cap(buf) {
+			_, _ = h.Write(buf)
+			buf = buf[:0]
+		}
+	}
+	forEachRun(bm.Bitmap, func(start, end uint32) bool {
+		if started && start == last+1 {
+			last = end
+			return true
+		}
+		if started {
+			flush()
+		}
+		first, last, started = start, end, true
+		return true
+	})
+	if started {
+		flush()
+	}
+	_, _ = h.Write(buf)
+}
+
+// forEachRun calls cb with runs of consecutive values in ascending order until it returns false, runs that touch
+// aren't merged. It reads the portable serialization because the 32-bit package doesn't expose its containers.
+func forEachRun(bm *roaring.Bitmap, cb func(first, last uint32) bool) {
+	data, err := bm.ToBytes()
+	if err != nil {
+		panic(err)
+	}
+	le := binary.LittleEndian
+
+	var size int
+	var runFlags []byte
+	if cookie := le.Uint32(data); cookie&0xFFFF == serialCookie {
+		size = int(cookie>>16) + 1
+		runFlags = data[4 : 4+(size+7)/8]
+		data = data[4+len(runFlags):]
+	} else {
+		size = int(le.Uint32(data[4:]))
+		data = data[8:]
+	}
+	header := data[:4*size]
+	data = data[4*size:]
+	if runFlags == nil || size >= noOffsetThreshold {
+		data = data[4*size:]
+	}
+
+	for i := 0; i < size; i++ {
+		base := uint32(le.Uint16(header[4*i:])) << 16
+		card := int(le.Uint16(header[4*i+2:])) + 1
+		switch {
+		case runFlags != nil && runFlags[i/8]&(1<<(uint(i)%8)) != 0:
+			runs := int(le.Uint16(data))
+			for j := 0; j < runs; j++ {
+				start := uint32(le.Uint16(data[2+4*j:]))
+				if !cb(base+start, base+start+uint32(le.Uint16(data[4+4*j:]))) {
+					return
+				}
+			}
+			data = data[2+4*runs:]
+		case card <= arrayContainerMax:
+			for j := 0; j < card; j++ {
+				v := base + uint32(le.Uint16(data[2*j:]))
+				if !cb(v, v) {
+					return
+				}
+			}
+			data = data[2*card:]
+		default:
+			for j := 0; j < 1024; j++ {
+				w := le.Uint64(data[8*j:])
+				for w != 0 {
+					start := bits.TrailingZeros64(w)
+					ones := bits.TrailingZeros64(^(w >> uint(start)))
+					offset := base + uint32(64*j+start)
+					if !cb(offset, offset+uint32(ones)-1) {
+						return
+					}
+					if start+ones == 64 {
+						break
+					}
+					w &^= 1<<uint(start+ones) - 1
+				}
+			}
+			data = data[8192:]
+		}
+	}
+}
+
+// fmix64 is the murmur3 finalizer, it spreads the bits of the fnv result before summing
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb53a3d8ee5b9
+	k ^= k >> 33
+	return k
+}
@@ -7,7 +7,7 @@ import (
 
 func (tm *BTreemap) Iterate(cb func(x uint64) bool) {
 	tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		var goOn bool
+		goOn := true
 		bm.Bitmap.Iterate(func(x uint32) bool {
 			goOn = cb(joinHiLo(bm.HighBits, x))
 			return goOn
@@ -33,10 +33,10 @@ func (tm *BTreemap) ReverseIterator() IntIterable {
 	iter := &u64ReverseIterator{
 		hiIter: tm.tree.Cursor(),
 	}
-	nxt := iter.hiIter.First()
+	nxt := iter.hiIter.Last()
 	if nxt != nil {
 		iter.next = nxt.(*keyedBitmap)
-		iter.loIter = iter.next.Iterator()
+		iter.loIter = iter.next.ReverseIterator()
 	}
 
 	return iter
@@ -56,56 +56,67 @@ func (tm *BTreemap) ManyIterator() ManyIntIterable {
 }
 
 type u64Iterator struct {
-	next      *keyedBitmap
-	hiIter    *btree.Cursor
-	loIter    roaring.IntPeekable
+	next   *keyedBitmap
+	hiIter *btree.Cursor
+	loIter roaring.IntPeekable
 }
 
 func (u *u64Iterator) PeekNext() uint64 {
-	peekable, ok := u.loIter.(roaring.IntPeekable)
-	if !ok {
+	if !u.HasNext() {
 		return 0
 	}
-	return joinHiLo(u.next.HighBits, peekable.PeekNext())
+	return joinHiLo(u.next.HighBits, u.loIter.PeekNext())
 }
 
 func (u *u64Iterator) AdvanceIfNeeded(minval uint64) {
+	if !u.HasNext() {
+		return
+	}
 	hi, lo := splitHiLo(minval)
-	key, cleanup := makeKey(hi)
-	defer cleanup()
-
 	if u.next.HighBits > hi {
 		return
 	}
 
-	candidate := u.hiIter.Seek(key)
-	if candidate == nil || candidate.(*keyedBitmap).HighBits != hi {
-		return
-	}
-	bm := candidate.(*keyedBitmap)
-	iter := bm.Iterator()
-	iter.AdvanceIfNeeded(lo)
+	if u.next.HighBits < hi {
+		key, cleanup := makeKey(hi)
+		defer cleanup()
 
-	u.next = bm
-	u.loIter = iter
-}
+		candidate := u.hiIter.Seek(key)
+		if candidate == nil {
+			u.next = nil
+			return
+		}
+		u.next = candidate.(*keyedBitmap)
+		u.loIter = u.next.Iterator()
+		if u.next.HighBits > hi {
+			return
+		}
+	}
 
-func (u *u64Iterator) HasNext() bool {
-	return u.next != nil && u.loIter.HasNext()
+	u.loIter.AdvanceIfNeeded(lo)
+	u.skipExhausted()
 }
 
-func (u *u64Iterator) Next() uint64 {
-	result := joinHiLo(u.next.HighBits, u.loIter.Next())
-	if !u.loIter.HasNext() {
+// skipExhausted moves to the next key when the values of the current one ran out
+func (u *u64Iterator) skipExhausted() {
+	for u.next != nil && !u.loIter.HasNext() {
 		nx := u.hiIter.Next()
 		if nx == nil {
 			u.next = nil
-			return result
+			return
 		}
 		u.next = nx.(*keyedBitmap)
 		u.loIter = u.next.Iterator()
 	}
+}
+
+func (u *u64Iterator) HasNext() bool {
+	return u.next != nil && u.loIter.HasNext()
+}
 
+func (u *u64Iterator) Next() uint64 {
+	result := joinHiLo(u.next.HighBits, u.loIter.Next())
+	u.skipExhausted()
 	return result
 }
 
@@ -136,26 +147,27 @@ func (u *u64ReverseIterator) Next() uint64 {
 	return result
 }
 
-
 type u64ManyIterator struct {
 	next   *keyedBitmap
 	hiIter *btree.Cursor
 	loIter roaring.ManyIntIterable
+	buf    []uint32
 }
 
-func (u u64ManyIterator) NextMany(uint64s []uint64) (n int) {
-	ln := len(uint64s)
-	uint32s := make([]uint32, len(uint64s))
-	for n < ln {
-		if u.next == nil {
-			break
+func (u *u64ManyIterator) NextMany(uint64s []uint64) (n int) {
+	if cap(u.buf) < len(uint64s) {
+		u.buf = make([]uint32, len(uint64s))
+	}
+	for n < len(uint64s) && u.next != nil {
+		nn := u.loIter.NextMany(u.buf[:len(uint64s)-n])
+		for i, lo := range u.buf[:nn] {
+			uint64s[n+i] = joinHiLo(u.next.HighBits, lo)
 		}
-
-		nn := u.loIter.NextMany(uint32s[n:])
 		n += nn
 		if nn == 0 {
 			nx := u.hiIter.Next()
 			if nx == nil {
+				u.next = nil
 				break
 			}
 			u.next = nx.(*keyedBitmap)
@@ -164,4 +176,3 @@ func (u u64ManyIterator) NextMany(uint64s []uint64) (n int) {
 	}
 	return
 }
-
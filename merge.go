@@ -0,0 +1,90 @@
+package roaring64
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/tidwall/btree"
+)
+
+// ErrOverlap is returned by Append and MergeDisjoint when the bitmaps share values or aren't in order
+var ErrOverlap = errors.New("bitmaps overlap")
+
+// Append moves the values of other into tm, every value of other must be above tm.Maximum().
+// The bitmaps of other are adopted as they are, only a high key both hold is merged,
+// and other is left empty. On error neither bitmap changes.
+func (tm *BTreemap) Append(other *BTreemap) error {
+	first := newKeyWalker(other).bm
+	if first == nil {
+		return nil
+	}
+	last := tm.lastBitmap()
+	if last != nil && (first.HighBits < last.HighBits ||
+		first.HighBits == last.HighBits && first.Minimum() <= last.Maximum()) {
+		return fmt.Errorf("%w: appending from %d after %d", ErrOverlap,
+			joinHiLo(first.HighBits, first.Minimum()), joinHiLo(last.HighBits, last.Maximum()))
+	}
+
+	tm.invalidate()
+	other.drain(func(bm *keyedBitmap) {
+		if last != nil && bm.HighBits == last.HighBits {
+			last.Or(bm.Bitmap)
+			return
+		}
+		tm.tree.ReplaceOrInsert(bm)
+	})
+	return nil
+}
+
+// MergeDisjoint moves the values of bitmaps that share no value into a new bitmap.
+// High keys held by a single input are adopted as they are, the others are merged with Or.
+// The inputs are left empty, on error none of them changes.
+func MergeDisjoint(bitmaps ...*BTreemap) (*BTreemap, error) {
+	// each input is checked against the running union of the ones before it in the same key,
+	// the union starts as a copy so the inputs stay untouched until every key is checked
+	var err error
+	var merged []*keyedBitmap
+	forEachKeyGroup(bitmaps, func(highBits uint32, group []*roaring.Bitmap) {
+		if err != nil {
+			return
+		}
+		union := group[0]
+		if len(group) > 1 {
+			union = union.Clone()
+		}
+		for _, bm := range group[1:] {
+			if union.Intersects(bm) {
+				err = fmt.Errorf("%w: the inputs share values in high key %d", ErrOverlap, highBits)
+				return
+			}
+			union.Or(bm)
+		}
+		merged = append(merged, &keyedBitmap{Bitmap: union, HighBits: highBits})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	answer := New()
+	for _, bm := range merged {
+		answer.tree.ReplaceOrInsert(bm)
+	}
+	for _, tm := range bitmaps {
+		tm.tree = btree.New(2, nil)
+	}
+	return answer, nil
+}
+
+// lastBitmap returns the bitmap of the largest non-empty high key, nil when tm is empty
+func (tm *BTreemap) lastBitmap() *keyedBitmap {
+	var last *keyedBitmap
+	tm.tree.Descend(func(i btree.Item) bool {
+		if bm := i.(*keyedBitmap); !bm.IsEmpty() {
+			last = bm
+			return false
+		}
+		return true
+	})
+	return last
+}
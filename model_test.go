@@ -0,0 +1,735 @@
+package roaring64
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// model is the reference set the treemap is checked against
+type model map[uint64]struct{}
+
+func (m model) sorted() []uint64 {
+	res := make([]uint64, 0, len(m))
+	for v := range m {
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+func (m model) clone() model {
+	res := make(model, len(m))
+	for v := range m {
+		res[v] = struct{}{}
+	}
+	return res
+}
+
+// forRange calls cb for every value in [start, end)
+func forRange(start, end uint64, cb func(uint64)) {
+	for v := start; v < end; v++ {
+		cb(v)
+	}
+}
+
+// smallRange keeps ranges short enough to mirror in the model, they still cross high keys
+// because values are biased toward the key boundaries
+func (p *program) smallRange() (uint64, uint64) {
+	start := p.value()
+	end := start + uint64(p.byte())*uint64(p.byte()%4+1)
+	if end < start {
+		end = math.MaxUint64
+	}
+	return start, end
+}
+
+func (p *program) operand() (*BTreemap, model) {
+	tm, m := New(), model{}
+	for i := p.byte() % 8; i > 0; i-- {
+		if p.byte()%4 == 0 {
+			start, end := p.smallRange()
+			tm.AddRange(start, end)
+			forRange(start, end, func(v uint64) { m[v] = struct{}{} })
+			continue
+		}
+		v := p.value()
+		tm.Add(v)
+		m[v] = struct{}{}
+	}
+	return tm, m
+}
+
+type differential struct {
+	t  *testing.T
+	tm *BTreemap
+	m  model
+	op string
+}
+
+func (d *differential) fatalf(format string, args ...interface{}) {
+	d.t.Helper()
+	d.t.Fatalf("%s: "+format, append([]interface{}{d.op}, args...)...)
+}
+
+// step applies one operation of the program to both the treemap and the model,
+// queries are compared on the spot
+func (d *differential) step(p *program) {
+	tm, m := d.tm, d.m
+	switch p.byte() % 37 {
+	case 0:
+		d.op = "Add"
+		v := p.value()
+		tm.Add(v)
+		m[v] = struct{}{}
+	case 1:
+		d.op = "CheckedAdd"
+		v := p.value()
+		_, exists := m[v]
+		if tm.CheckedAdd(v) == exists {
+			d.fatalf("reported %v for %d", exists, v)
+		}
+		m[v] = struct{}{}
+	case 2:
+		d.op = "Remove"
+		v := p.value()
+		tm.Remove(v)
+		delete(m, v)
+	case 3:
+		d.op = "CheckedRemove"
+		v := p.value()
+		_, exists := m[v]
+		if tm.CheckedRemove(v) != exists {
+			d.fatalf("reported %v for %d", !exists, v)
+		}
+		delete(m, v)
+	case 4:
+		d.op = "AddRange"
+		start, end := p.smallRange()
+		tm.AddRange(start, end)
+		forRange(start, end, func(v uint64) { m[v] = struct{}{} })
+	case 5:
+		d.op = "RemoveRange"
+		start, end := p.smallRange()
+		tm.RemoveRange(start, end)
+		forRange(start, end, func(v uint64) { delete(m, v) })
+	case 6:
+		d.op = "Flip"
+		start, end := p.smallRange()
+		tm.Flip(start, end)
+		forRange(start, end, func(v uint64) {
+			if _, ok := m[v]; ok {
+				delete(m, v)
+			} else {
+				m[v] = struct{}{}
+			}
+		})
+	case 7:
+		d.op = "And"
+		other, om := p.operand()
+		tm.And(other)
+		for v := range m {
+			if _, ok := om[v]; !ok {
+				delete(m, v)
+			}
+		}
+	case 8:
+		d.op = "Or"
+		other, om := p.operand()
+		tm.Or(other)
+		for v := range om {
+			m[v] = struct{}{}
+		}
+	case 9:
+		d.op = "Xor"
+		other, om := p.operand()
+		tm.Xor(other)
+		for v := range om {
+			if _, ok := m[v]; ok {
+				delete(m, v)
+			} else {
+				m[v] = struct{}{}
+			}
+		}
+	case 10:
+		d.op = "AndNot"
+		other, om := p.operand()
+		tm.AndNot(other)
+		for v := range om {
+			delete(m, v)
+		}
+	case 11:
+		d.op = "Cardinalities"
+		other, om := p.operand()
+		var and uint64
+		for v := range om {
+			if _, ok := m[v]; ok {
+				and++
+			}
+		}
+		if c := tm.AndCardinality(other); c != and {
+			d.fatalf("AndCardinality is %d, expected %d", c, and)
+		}
+		if c := tm.OrCardinality(other); c != uint64(len(m)+len(om))-and {
+			d.fatalf("OrCardinality is %d, expected %d", c, uint64(len(m)+len(om))-and)
+		}
+		if tm.Intersects(other) != (and > 0) {
+			d.fatalf("Intersects disagrees with an intersection of %d", and)
+		}
+	case 12:
+		d.op = "Contains"
+		v := p.value()
+		if _, ok := m[v]; tm.Contains(v) != ok {
+			d.fatalf("Contains(%d) is %v", v, !ok)
+		}
+	case 13:
+		d.op = "Rank"
+		v := p.value()
+		var rank uint64
+		for x := range m {
+			if x <= v {
+				rank++
+			}
+		}
+		if r := tm.Rank(v); r != rank {
+			d.fatalf("Rank(%d) is %d, expected %d", v, r, rank)
+		}
+	case 14:
+		d.op = "Select"
+		sorted := m.sorted()
+		i := uint64(p.byte())
+		if len(sorted) > 0 && p.byte()%2 == 0 {
+			i = uint64(len(sorted)) - 1 - i%uint64(len(sorted))
+		}
+		v, err := tm.Select(i)
+		if i >= uint64(len(sorted)) {
+			if err == nil {
+				d.fatalf("Select(%d) returned %d from %d values", i, v, len(sorted))
+			}
+			return
+		}
+		if err != nil || v != sorted[i] {
+			d.fatalf("Select(%d) is %d (%v), expected %d", i, v, err, sorted[i])
+		}
+	case 15:
+		d.op = "Iterator"
+		sorted := m.sorted()
+		iter := tm.Iterator()
+		i := 0
+		for iter.HasNext() {
+			if p.byte()%4 == 0 && i < len(sorted) {
+				target := p.value()
+				iter.AdvanceIfNeeded(target)
+				for i < len(sorted) && sorted[i] < target {
+					i++
+				}
+				if !iter.HasNext() {
+					break
+				}
+			}
+			if i >= len(sorted) {
+				d.fatalf("walked past the %d values", len(sorted))
+			}
+			if peek := iter.PeekNext(); peek != sorted[i] {
+				d.fatalf("PeekNext is %d, expected %d", peek, sorted[i])
+			}
+			if v := iter.Next(); v != sorted[i] {
+				d.fatalf("Next is %d, expected %d", v, sorted[i])
+			}
+			i++
+		}
+		if i != len(sorted) {
+			d.fatalf("stopped after %d of %d values", i, len(sorted))
+		}
+	case 16:
+		d.op = "ReverseIterator"
+		sorted := m.sorted()
+		iter := tm.ReverseIterator()
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if !iter.HasNext() {
+				d.fatalf("stopped with %d values left", i+1)
+			}
+			if v := iter.Next(); v != sorted[i] {
+				d.fatalf("Next is %d, expected %d", v, sorted[i])
+			}
+		}
+		if iter.HasNext() {
+			d.fatalf("walked past the %d values", len(sorted))
+		}
+	case 17:
+		d.op = "ManyIterator"
+		var res []uint64
+		buf := make([]uint64, int(p.byte()%16)+1)
+		iter := tm.ManyIterator()
+		for n := iter.NextMany(buf); n > 0; n = iter.NextMany(buf) {
+			res = append(res, buf[:n]...)
+		}
+		d.compareValues(res)
+	case 18:
+		d.op = "Iterate"
+		var res []uint64
+		limit := len(m)
+		if len(m) > 0 && p.byte()%2 == 0 {
+			limit = int(p.byte()) % len(m)
+		}
+		tm.Iterate(func(x uint64) bool {
+			res = append(res, x)
+			return len(res) <= limit
+		})
+		if sorted := m.sorted(); limit < len(sorted) {
+			m = model{}
+			for _, v := range sorted[:limit+1] {
+				m[v] = struct{}{}
+			}
+			(&differential{t: d.t, tm: d.tm, m: m, op: d.op}).compareValues(res)
+			return
+		}
+		d.compareValues(res)
+	case 19:
+		d.op = "RoundTrip"
+		format := Format(p.byte() % 2)
+		data, err := tm.WithFormat(format).ToBytes()
+		if err != nil {
+			d.fatalf("%v", err)
+		}
+		read, _, err := ReadAny(bufio.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			d.fatalf("%v", err)
+		}
+		if !read.Equals(tm) || read.Format() != format {
+			d.fatalf("read back %v in %v", read, read.Format())
+		}
+		d.tm = read
+	case 20:
+		d.op = "RunOptimize"
+		tm.RunOptimize()
+	case 21:
+		d.op = "Clone"
+		cloned := tm.Clone()
+		if !cloned.Equals(tm) {
+			d.fatalf("clone differs")
+		}
+		d.tm = cloned
+		if p.byte()%16 == 0 {
+			d.op = "Clear"
+			d.tm.Clear()
+			d.m = model{}
+		}
+	case 22:
+		d.op = "RemoveShard"
+		shard := uint32(p.value() >> 32)
+		var rows uint64
+		for v := range m {
+			if uint32(v>>32) == shard {
+				rows++
+				delete(m, v)
+			}
+		}
+		if c := tm.CardinalityOf(shard); c != rows {
+			d.fatalf("shard %d has %d rows, expected %d", shard, c, rows)
+		}
+		if tm.RemoveShard(shard) != (rows > 0) {
+			d.fatalf("reported %v for shard %d with %d rows", rows == 0, shard, rows)
+		}
+	case 23:
+		delta := p.offset()
+		d.op = fmt.Sprintf("AddOffset(%d)", delta)
+		d.tm = tm.AddOffset(delta)
+		d.m = model{}
+		for v := range m {
+			shifted := v + uint64(delta)
+			if (delta >= 0) == (shifted >= v) {
+				d.m[shifted] = struct{}{}
+			}
+		}
+	case 24:
+		d.op = "Complement"
+		start, end := p.smallRange()
+		complement := tm.Complement(start, end)
+		if err := complement.Validate(); err != nil {
+			d.fatalf("%v", err)
+		}
+		expected := model{}
+		forRange(start, end, func(v uint64) {
+			if _, ok := m[v]; !ok {
+				expected[v] = struct{}{}
+			}
+		})
+		(&differential{t: d.t, tm: complement, m: expected, op: d.op}).compareValues(complement.ToArray())
+	case 25:
+		d.op = "Not"
+		start, end := p.smallRange()
+		tm.Not(start, end)
+		forRange(start, end, func(v uint64) {
+			if _, ok := m[v]; ok {
+				delete(m, v)
+			} else {
+				m[v] = struct{}{}
+			}
+		})
+	case 26:
+		d.op = "Compare"
+		other, om := p.operand()
+		switch p.byte() % 3 {
+		case 0:
+			// a copy of tm that gained or lost a value
+			other, om = tm.Clone(), m.clone()
+			v := p.value()
+			if p.byte()%2 == 0 {
+				other.Remove(v)
+				delete(om, v)
+			} else {
+				other.Add(v)
+				om[v] = struct{}{}
+			}
+		case 1:
+			// a superset of tm
+			other.Or(tm)
+			for v := range m {
+				om[v] = struct{}{}
+			}
+		}
+		d.compareSets(other, om)
+	case 27:
+		d.op = "Hash"
+		rebuilt := New()
+		for _, v := range m.sorted() {
+			rebuilt.Add(v)
+		}
+		if tm.Hash64() != rebuilt.Hash64() || tm.Hash128() != rebuilt.Hash128() {
+			d.fatalf("hash differs from a bitmap rebuilt value by value")
+		}
+		hi := uint32(p.value() >> 32)
+		before, keyBefore := tm.Hash64(), tm.KeyHash64(hi)
+		row := uint32(p.value())
+		tm.AddPair(hi, row)
+		m[joinHiLo(hi, row)] = struct{}{}
+		if tm.Hash64() != before-keyBefore+tm.KeyHash64(hi) {
+			d.fatalf("hash can't be updated through KeyHash64(%d)", hi)
+		}
+	case 28:
+		d.op = "Threshold"
+		bitmaps, counts := []*BTreemap{tm}, map[uint64]int{}
+		for v := range m {
+			counts[v]++
+		}
+		for i := p.byte()%4 + 1; i > 0; i-- {
+			other, om := p.operand()
+			bitmaps = append(bitmaps, other)
+			for v := range om {
+				counts[v]++
+			}
+		}
+		occ := CountOccurrences(bitmaps...)
+		for v, count := range counts {
+			if got := occ.Count(v); got != count {
+				d.fatalf("%d occurs %d times, counted %d", v, count, got)
+			}
+		}
+		t := int(p.byte())%len(bitmaps) + 1
+		if !occ.AtLeast(t).Equals(Threshold(t, bitmaps...)) {
+			d.fatalf("AtLeast(%d) differs from Threshold(%d)", t, t)
+		}
+		d.tm = Threshold(t, bitmaps...)
+		d.m = model{}
+		for v, count := range counts {
+			if count >= t {
+				d.m[v] = struct{}{}
+			}
+		}
+	case 29:
+		d.op = "Page"
+		sorted := m.sorted()
+		offset, limit := uint64(p.byte())*uint64(p.byte()), uint64(p.byte())
+		if p.byte()%8 == 0 {
+			limit = math.MaxUint64
+		}
+		var expected []uint64
+		if offset < uint64(len(sorted)) {
+			expected = sorted[offset:]
+			if limit < uint64(len(expected)) {
+				expected = expected[:limit]
+			}
+		}
+		page := tm.Page(offset, limit)
+		if len(page) != len(expected) {
+			d.fatalf("Page(%d, %d) returned %d values, expected %d", offset, limit, len(page), len(expected))
+		}
+		for i, v := range page {
+			if v != expected[i] {
+				d.fatalf("Page(%d, %d)[%d] is %d, expected %d", offset, limit, i, v, expected[i])
+			}
+		}
+	case 30:
+		d.op = "Sample"
+		rng := rand.New(rand.NewSource(int64(p.byte())))
+		k := int(p.byte())
+		sample := tm.Sample(k, rng)
+		expected := k
+		if len(m) < k {
+			expected = len(m)
+		}
+		if len(sample) != expected {
+			d.fatalf("sampled %d values, expected %d", len(sample), expected)
+		}
+		for i, v := range sample {
+			if _, ok := m[v]; !ok || (i > 0 && sample[i-1] >= v) {
+				d.fatalf("sample %v isn't an ascending subset", sample)
+			}
+		}
+		var permuted []uint64
+		for it := tm.PermutedIterator(int64(p.byte())); it.HasNext(); {
+			permuted = append(permuted, it.Next())
+		}
+		sort.Slice(permuted, func(i, j int) bool { return permuted[i] < permuted[j] })
+		d.compareValues(permuted)
+	case 31:
+		v := p.value()
+		d.op = fmt.Sprintf("SplitAt(%d)", v)
+		lower, upper := tm.SplitAt(v)
+		if !tm.IsEmpty() {
+			d.fatalf("the split left values behind")
+		}
+		// flipping the cut key of lower must not show in upper
+		cut := joinHiLo(uint32(v>>32), 0)
+		lower.Flip(cut, v)
+		lower.Flip(cut, v)
+		lm, um := model{}, model{}
+		for x := range m {
+			if x < v {
+				lm[x] = struct{}{}
+			} else {
+				um[x] = struct{}{}
+			}
+		}
+		d.tm, d.m = upper, um
+		d.check()
+		d.tm, d.m = lower, lm
+	case 32:
+		d.op = "Partition"
+		n := int(p.byte()%5) + 1
+		var parts []*BTreemap
+		if p.byte()%2 == 0 {
+			parts = tm.PartitionByCardinality(n)
+			if len(parts) != n {
+				d.fatalf("%d parts, expected %d", len(parts), n)
+			}
+			for i, part := range parts {
+				if c := part.GetCardinality(); c < uint64(len(m)/n) || c > uint64(len(m)/n+1) {
+					d.fatalf("part %d holds %d of %d values", i, c, len(m))
+				}
+				if i > 0 && !part.IsEmpty() && !parts[i-1].IsEmpty() && parts[i-1].Maximum() >= part.Minimum() {
+					d.fatalf("part %d overlaps the one before", i)
+				}
+			}
+		} else {
+			parts = tm.PartitionByHighBits(func(hi uint32) int { return int(hi) % n })
+			for i, part := range parts {
+				part.Iterate(func(x uint64) bool {
+					if int(x>>32)%n != i {
+						d.fatalf("%d is in part %d", x, i)
+					}
+					return true
+				})
+			}
+		}
+		if !tm.IsEmpty() {
+			d.fatalf("the partition left values behind")
+		}
+		d.tm = FastOr(parts...)
+	case 33:
+		d.op = "Append"
+		lower, upper := tm.SplitAt(p.value())
+		if !lower.IsEmpty() && !upper.IsEmpty() {
+			if err := upper.Append(lower); !errors.Is(err, ErrOverlap) {
+				d.fatalf("appending lower values returned %v", err)
+			}
+		}
+		if err := lower.Append(upper); err != nil {
+			d.fatalf("%v", err)
+		}
+		if !upper.IsEmpty() {
+			d.fatalf("the appended bitmap isn't empty")
+		}
+		d.tm = lower
+	case 34:
+		d.op = "MergeDisjoint"
+		other, om := p.operand()
+		overlap := false
+		for v := range om {
+			if _, ok := m[v]; ok {
+				overlap = true
+			}
+		}
+		merged, err := MergeDisjoint(tm, other)
+		if overlap {
+			if !errors.Is(err, ErrOverlap) {
+				d.fatalf("merging overlapping bitmaps returned %v", err)
+			}
+			return
+		}
+		if err != nil {
+			d.fatalf("%v", err)
+		}
+		d.tm = merged
+		for v := range om {
+			m[v] = struct{}{}
+		}
+	case 35:
+		d.op = "TryOr"
+		limit := tm.GetSizeInBytes() + uint64(p.byte())*16
+		tm.WithSizeLimit(limit)
+		var err error
+		var added model
+		switch p.byte() % 3 {
+		case 0:
+			d.op = "TryAdd"
+			v := p.value()
+			err, added = tm.TryAdd(v), model{v: struct{}{}}
+		case 1:
+			d.op = "TryAddRange"
+			start, end := p.smallRange()
+			added = model{}
+			forRange(start, end, func(v uint64) { added[v] = struct{}{} })
+			err = tm.TryAddRange(start, end)
+		default:
+			var other *BTreemap
+			other, added = p.operand()
+			err = tm.TryOr(other)
+		}
+		if used := tm.usedBytes(); used != tm.GetSizeInBytes() {
+			d.fatalf("tracked %d bytes, using %d", used, tm.GetSizeInBytes())
+		}
+		tm.WithSizeLimit(0)
+		if err != nil {
+			if !errors.Is(err, ErrSizeLimit) {
+				d.fatalf("%v", err)
+			}
+			return
+		}
+		if tm.GetSizeInBytes() > limit {
+			d.fatalf("%d bytes are over the limit of %d", tm.GetSizeInBytes(), limit)
+		}
+		for v := range added {
+			m[v] = struct{}{}
+		}
+	case 36:
+		d.op = "Compact"
+		// an empty key as decoding or getOrInsert can leave behind
+		tm.getOrInsert(uint32(p.value() >> 32))
+		tm.Compact(p.byte()%2 == 0)
+		if keys := len(tm.Shards()); tm.tree.Len() != keys {
+			d.fatalf("%d keys left for %d with values", tm.tree.Len(), keys)
+		}
+	}
+}
+
+// compareSets checks the set comparisons of d.tm against other
+func (d *differential) compareSets(other *BTreemap, om model) {
+	d.t.Helper()
+	subset, superset, disjoint := true, true, true
+	for v := range d.m {
+		if _, ok := om[v]; ok {
+			disjoint = false
+		} else {
+			subset = false
+		}
+	}
+	for v := range om {
+		if _, ok := d.m[v]; !ok {
+			superset = false
+		}
+	}
+	if d.tm.IsSubsetOf(other) != subset || other.IsSubsetOf(d.tm) != superset {
+		d.fatalf("IsSubsetOf is %v and %v, expected %v and %v", d.tm.IsSubsetOf(other), other.IsSubsetOf(d.tm), subset, superset)
+	}
+	if d.tm.IsStrictSubsetOf(other) != (subset && !superset) {
+		d.fatalf("IsStrictSubsetOf is %v, expected %v", !(subset && !superset), subset && !superset)
+	}
+	if d.tm.IsDisjoint(other) != disjoint {
+		d.fatalf("IsDisjoint is %v, expected %v", !disjoint, disjoint)
+	}
+
+	// lexicographic order of the sorted values, a prefix sorts first
+	l, r := d.m.sorted(), om.sorted()
+	i := 0
+	for i < len(l) && i < len(r) && l[i] == r[i] {
+		i++
+	}
+	expected := 0
+	switch {
+	case i < len(l) && i < len(r) && l[i] < r[i], i == len(l) && i < len(r):
+		expected = -1
+	case i < len(l):
+		expected = 1
+	}
+	if c := d.tm.Compare(other); c != expected {
+		d.fatalf("Compare is %d, expected %d", c, expected)
+	}
+	if c := other.Compare(d.tm); c != -expected {
+		d.fatalf("reversed Compare is %d, expected %d", c, -expected)
+	}
+}
+
+func (d *differential) compareValues(actual []uint64) {
+	d.t.Helper()
+	expected := d.m.sorted()
+	if len(actual) != len(expected) {
+		d.fatalf("%d values, expected %d", len(actual), len(expected))
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			d.fatalf("value %d is %d, expected %d", i, actual[i], expected[i])
+		}
+	}
+}
+
+func (d *differential) check() {
+	d.t.Helper()
+	if err := d.tm.Validate(); err != nil {
+		d.fatalf("%v", err)
+	}
+	if c := d.tm.GetCardinality(); c != uint64(len(d.m)) {
+		d.fatalf("cardinality is %d, expected %d", c, len(d.m))
+	}
+	if d.tm.IsEmpty() != (len(d.m) == 0) {
+		d.fatalf("IsEmpty is %v with %d values", d.tm.IsEmpty(), len(d.m))
+	}
+	d.compareValues(d.tm.ToArray())
+	if len(d.m) > 0 {
+		sorted := d.m.sorted()
+		if d.tm.Minimum() != sorted[0] || d.tm.Maximum() != sorted[len(sorted)-1] {
+			d.fatalf("bounds are [%d, %d], expected [%d, %d]", d.tm.Minimum(), d.tm.Maximum(), sorted[0], sorted[len(sorted)-1])
+		}
+	}
+}
+
+func runDifferential(t *testing.T, data []byte) {
+	p := &program{data: data}
+	d := &differential{t: t, tm: New(), m: model{}}
+	// half of the programs run with the cardinality index, kept across ops that return new bitmaps
+	indexed := p.byte()%2 == 1
+	for !p.done() {
+		if indexed && d.tm.cardinalities == nil {
+			d.tm.WithCardinalityIndex()
+		}
+		d.step(p)
+		d.check()
+	}
+}
+
+// TestTreemap_StateMachine drives the differential operations with random byte streams,
+// the way smat drives state machines from fuzzer input.
+func TestTreemap_StateMachine(t *testing.T) {
+	rng := rand.New(rand.NewSource(35))
+	for i := 0; i < 300; i++ {
+		data := make([]byte, 32+rng.Intn(512))
+		rng.Read(data)
+		runDifferential(t, data)
+	}
+}
@@ -0,0 +1,86 @@
+package roaring64
+
+import (
+	"math"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// AddOffset returns a new bitmap with delta added to every value, values that end up
+// below 0 or above math.MaxUint64 are dropped.
+// A multiple of 2^32 only rewrites the high keys, any other delta splits
+// every bitmap across two adjacent high keys.
+func (tm *BTreemap) AddOffset(delta int64) *BTreemap {
+	result := New()
+	// delta = keyDelta*2^32 + loDelta with 0 <= loDelta < 2^32
+	keyDelta, loDelta := delta>>32, uint64(delta)&math.MaxUint32
+
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		if bm.IsEmpty() {
+			return true
+		}
+		if loDelta == 0 {
+			if hi, ok := offsetKey(bm.HighBits, keyDelta); ok {
+				result.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm.Bitmap.Clone(), HighBits: hi})
+			}
+			return true
+		}
+
+		// values below cut stay in the key, the others carry into the next one
+		cut := 1<<32 - loDelta
+		if hi, ok := offsetKey(bm.HighBits, keyDelta); ok && uint64(bm.Minimum()) < cut {
+			low := bm.Bitmap
+			if uint64(bm.Maximum()) >= cut {
+				low = bm.Bitmap.Clone()
+				low.RemoveRange(cut, 1<<32)
+			}
+			result.orInto(hi, roaring.AddOffset64(low, int64(loDelta)))
+		}
+		if hi, ok := offsetKey(bm.HighBits, keyDelta+1); ok && uint64(bm.Maximum()) >= cut {
+			high := bm.Bitmap
+			if uint64(bm.Minimum()) < cut {
+				high = bm.Bitmap.Clone()
+				high.RemoveRange(0, cut)
+			}
+			result.orInto(hi, shiftDown(high, cut))
+		}
+		return true
+	})
+	return result
+}
+
+// shiftDown subtracts n from every value of a bitmap whose values are all at least n.
+// roaring.AddOffset64 drops everything for offsets of -(2^32 - 2^16) or less,
+// so larger shifts take two steps.
+func shiftDown(bm *roaring.Bitmap, n uint64) *roaring.Bitmap {
+	if n > 1<<31 {
+		bm = roaring.AddOffset64(bm, -(1 << 31))
+		n -= 1 << 31
+	}
+	return roaring.AddOffset64(bm, -int64(n))
+}
+
+// offsetKey moves a high key by delta, ok is false when it falls outside the uint32 range
+func offsetKey(highBits uint32, delta int64) (uint32, bool) {
+	key := int64(highBits) + delta
+	if key < 0 || key > math.MaxUint32 {
+		return 0, false
+	}
+	return uint32(key), true
+}
+
+// orInto merges bm into the given high key, it takes ownership of bm
+func (tm *BTreemap) orInto(highBits uint32, bm *roaring.Bitmap) {
+	if bm.IsEmpty() {
+		return
+	}
+	key, cleanup := makeKey(highBits)
+	defer cleanup()
+	tm.invalidate()
+
+	if existing, found := tm.get(key); found {
+		existing.Or(bm)
+		return
+	}
+	tm.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm, HighBits: highBits})
+}
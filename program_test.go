@@ -0,0 +1,154 @@
+package roaring64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// program decodes fuzzer input into operations and their arguments,
+// running out of input yields zeros so every input is a valid program.
+type program struct {
+	data []byte
+}
+
+func (p *program) done() bool {
+	return len(p.data) == 0
+}
+
+func (p *program) byte() byte {
+	if len(p.data) == 0 {
+		return 0
+	}
+	b := p.data[0]
+	p.data = p.data[1:]
+	return b
+}
+
+func (p *program) uint64() uint64 {
+	var buf [8]byte
+	n := copy(buf[:], p.data)
+	p.data = p.data[n:]
+	return binary.LittleEndian.Uint64(buf[:])
+}
+
+// value is biased toward the edges of high keys and of the uint64 range
+func (p *program) value() uint64 {
+	small := uint64(p.byte())
+	switch p.byte() % 6 {
+	case 0:
+		return small
+	case 1:
+		return uint64(p.byte()%4)<<32 + small
+	case 2:
+		return uint64(p.byte()%4+1)<<32 - small - 1
+	case 3:
+		return math.MaxUint64 - small
+	case 4:
+		return math.MaxUint64 - uint64(p.byte()%4)<<32 - small
+	default:
+		return p.uint64()
+	}
+}
+
+// span is a range length, at most a few high keys long so a program stays cheap
+func (p *program) span() uint64 {
+	switch p.byte() % 3 {
+	case 0:
+		return uint64(p.byte())
+	case 1:
+		return uint64(p.byte()) << 16
+	default:
+		return uint64(p.byte()%2)<<32 + uint64(p.byte())
+	}
+}
+
+// offset is biased toward whole high keys and containers, and toward carries into the next key
+func (p *program) offset() int64 {
+	small := int64(int8(p.byte()))
+	switch p.byte() % 5 {
+	case 0:
+		return small
+	case 1:
+		return small % 4 << 32
+	case 2:
+		return small << 16
+	case 3:
+		if small < 0 {
+			return -1<<32 - small
+		}
+		return 1<<32 - small
+	default:
+		return int64(p.uint64())
+	}
+}
+
+func (p *program) rangeArgs() (uint64, uint64) {
+	start := p.value()
+	end := start + p.span()
+	if end < start {
+		end = math.MaxUint64
+	}
+	return start, end
+}
+
+func (p *program) treemap() *BTreemap {
+	tm := New()
+	for i := p.byte() % 8; i > 0; i-- {
+		if p.byte()%4 == 0 {
+			start, end := p.rangeArgs()
+			tm.AddRange(start, end)
+			continue
+		}
+		tm.Add(p.value())
+	}
+	return tm
+}
+
+const numOps = 15
+
+// mutate applies one operation of the program to tm
+func (p *program) mutate(t *testing.T, tm *BTreemap) {
+	switch p.byte() % numOps {
+	case 0:
+		tm.Add(p.value())
+	case 1:
+		tm.CheckedAdd(p.value())
+	case 2:
+		tm.Remove(p.value())
+	case 3:
+		tm.CheckedRemove(p.value())
+	case 4:
+		tm.AddRange(p.rangeArgs())
+	case 5:
+		tm.RemoveRange(p.rangeArgs())
+	case 6:
+		tm.Flip(p.rangeArgs())
+	case 7:
+		tm.And(p.treemap())
+	case 8:
+		tm.Or(p.treemap())
+	case 9:
+		tm.Xor(p.treemap())
+	case 10:
+		tm.AndNot(p.treemap())
+	case 11:
+		if p.byte()%8 == 0 {
+			tm.Clear()
+		}
+	case 12:
+		tm.RunOptimize()
+	case 13:
+		data, err := tm.ToBytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm.Clear()
+		if _, err := tm.ReadFrom(bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	case 14:
+		tm.tree = tm.AddOffset(p.offset()).tree
+	}
+}
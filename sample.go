@@ -0,0 +1,124 @@
+package roaring64
+
+import (
+	"errors"
+	"math"
+	"math/bits"
+	"math/rand"
+	"sort"
+)
+
+var errEmptySample = errors.New("can't pick a random value from an empty bitmap")
+
+// RandomValue returns a uniformly chosen value, it fails when the bitmap is empty
+func (tm *BTreemap) RandomValue(rng *rand.Rand) (uint64, error) {
+	card := tm.GetCardinality()
+	if card == 0 {
+		return 0, errEmptySample
+	}
+	return tm.Select(uniform(rng, card))
+}
+
+// Sample returns k distinct values chosen uniformly without replacement, in ascending order.
+// Only the chosen ranks are materialized, they are resolved with Select on the key that holds them.
+// When k is at least the cardinality every value is returned.
+func (tm *BTreemap) Sample(k int, rng *rand.Rand) []uint64 {
+	card := tm.GetCardinality()
+	if k <= 0 || card == 0 {
+		return nil
+	}
+	if uint64(k) >= card {
+		return tm.ToArray()
+	}
+
+	// Floyd's algorithm draws k distinct ranks with k random numbers
+	chosen := make(map[uint64]struct{}, k)
+	for j := card - uint64(k); j < card; j++ {
+		r := uniform(rng, j+1)
+		if _, dup := chosen[r]; dup {
+			r = j
+		}
+		chosen[r] = struct{}{}
+	}
+	ranks := make([]uint64, 0, k)
+	for r := range chosen {
+		ranks = append(ranks, r)
+	}
+	sort.Slice(ranks, func(i, j int) bool { return ranks[i] < ranks[j] })
+
+	values := make([]uint64, 0, k)
+	var before uint64
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		after := before + bm.GetCardinality()
+		for len(ranks) > 0 && ranks[0] < after {
+			lo, _ := bm.Select(uint32(ranks[0] - before))
+			values = append(values, joinHiLo(bm.HighBits, lo))
+			ranks = ranks[1:]
+		}
+		before = after
+		return len(ranks) > 0
+	})
+	return values
+}
+
+// PermutedIterator visits every value once in a pseudo-random order that only depends on the seed
+// and the values. It shuffles ranks with a keyed Feistel network instead of materializing the values,
+// every step is a Select on the key holding the rank. The bitmap must not change during the iteration.
+func (tm *BTreemap) PermutedIterator(seed int64) IntIterable {
+	it := &permutedIterator{}
+	it.index.build(tm)
+
+	// the network permutes [0, 2^(2*half)), ranks beyond the cardinality are walked past
+	width := bits.Len64(it.index.total - 1)
+	it.half = uint(width+1) / 2
+	rng := rand.New(rand.NewSource(seed))
+	for i := range it.keys {
+		it.keys[i] = rng.Uint64()
+	}
+	return it
+}
+
+type permutedIterator struct {
+	index cardinalityIndex
+	half  uint
+	keys  [4]uint64
+	pos   uint64
+}
+
+func (it *permutedIterator) HasNext() bool {
+	return it.pos < it.index.total
+}
+
+func (it *permutedIterator) Next() uint64 {
+	rank := it.permute(it.pos)
+	for rank >= it.index.total {
+		rank = it.permute(rank)
+	}
+	it.pos++
+
+	key := it.index.keys[it.index.find(rank)]
+	lo, _ := key.bm.Select(uint32(rank - key.before))
+	return joinHiLo(key.bm.HighBits, lo)
+}
+
+// permute is a bijection on [0, 2^(2*half)), cycle walking keeps its restriction to the ranks a bijection
+func (it *permutedIterator) permute(x uint64) uint64 {
+	mask := uint64(1)<<it.half - 1
+	l, r := x>>it.half, x&mask
+	for _, k := range it.keys {
+		l, r = r, l^(fmix64(r^k)&mask)
+	}
+	return l<<it.half | r
+}
+
+// uniform returns a uniformly distributed number in [0, n), n must not be 0
+func uniform(rng *rand.Rand, n uint64) uint64 {
+	if n <= math.MaxInt64 {
+		return uint64(rng.Int63n(int64(n)))
+	}
+	for {
+		if v := rng.Uint64(); v < n {
+			return v
+		}
+	}
+}
@@ -3,11 +3,9 @@ package roaring64
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/binary"
 	"io"
 	"sync"
 
-	"github.com/RoaringBitmap/roaring"
 	"github.com/tidwall/btree"
 )
 
@@ -22,10 +20,31 @@ func (tm *BTreemap) WithCppSerializer() *BTreemap {
 // found in RoaringBitmap Java implementation at:
 // https://github.com/RoaringBitmap/RoaringBitmap/blob/master/roaringbitmap/src/main/java/org/roaringbitmap/longlong/Roaring64NavigableMap.java
 func (tm *BTreemap) WithJvmSerializer() *BTreemap {
-	tm.serializer = &jvmSerializer{tm}
+	tm.serializer = &jvmSerializer{tm: tm}
 	return tm
 }
 
+// serializer that is compatible with a JVM Treemap created with signedLongs=true,
+// the signed-longs flag is set and high keys are written in signed int32 order.
+// Both jvm serializers read either flag and keep the one they found for later writes.
+func (tm *BTreemap) WithJvmSignedSerializer() *BTreemap {
+	tm.serializer = &jvmSerializer{tm: tm, signed: true}
+	return tm
+}
+
+// WithFormat configures the serializer for the given format
+func (tm *BTreemap) WithFormat(format Format) *BTreemap {
+	if format == FormatJvm {
+		return tm.WithJvmSerializer()
+	}
+	return tm.WithCppSerializer()
+}
+
+// Format returns the serialization format used by WriteTo and ReadFrom
+func (tm *BTreemap) Format() Format {
+	return tm.serializer.format()
+}
+
 func (tm *BTreemap) ToBase64() (string, error) {
 	buf := new(bytes.Buffer)
 	_, err := tm.WriteTo(buf)
@@ -105,144 +124,161 @@ type serializer interface {
 	io.WriterTo
 	io.ReaderFrom
 	GetSerializedSizeInBytes() uint64
+	format() Format
 }
 
 type cppSerializer struct {
 	tm *BTreemap
 }
 
-func (j *cppSerializer) GetSerializedSizeInBytes() uint64 {
-	n := 8 + (uint64(j.tm.tree.Len()) * 4)
-	j.tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		n += bm.GetSerializedSizeInBytes()
-		return true
-	})
-	return n
+func (c *cppSerializer) format() Format {
+	return FormatCpp
+}
+
+func (c *cppSerializer) GetSerializedSizeInBytes() uint64 {
+	return serializedSize(c.tm, FormatCpp)
 }
 
 func (c *cppSerializer) WriteTo(w io.Writer) (int64, error) {
-	if err := binary.Write(w, binary.LittleEndian, uint64(c.tm.tree.Len())); err != nil {
-		return 0, err
+	return writeTree(w, FormatCpp, c.tm)
+}
+
+func (c *cppSerializer) ReadFrom(r io.Reader) (int64, error) {
+	tree, _, n, err := readTree(r, FormatCpp)
+	if err != nil {
+		return n, err
 	}
+	c.tm.tree = tree
+	return n, nil
+}
 
-	n := int64(8)
-	var err error
-	c.tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		if err = binary.Write(w, binary.LittleEndian, bm.HighBits); err != nil {
-			return false
-		}
-		n += 4
-		nn, er := bm.WriteTo(w)
-		if er != nil {
-			err = er
-			return false
-		}
-		n += nn
-		return true
-	})
-	return n, err
+type jvmSerializer struct {
+	tm     *BTreemap
+	signed bool
 }
 
-func (c *cppSerializer) ReadFrom(r io.Reader) (n int64, err error) {
-	tm := btree.New(2, nil)
-	var sz uint64
-	if err = binary.Read(r, binary.LittleEndian, &sz); err != nil {
-		return
-	}
+func (j *jvmSerializer) format() Format {
+	return FormatJvm
+}
 
-	n = int64(8)
-	for i := uint64(0); i < sz; i++ {
-		var highBits uint32
-		if err = binary.Read(r, binary.LittleEndian, &highBits); err != nil {
-			return
-		}
-		n += 4
-		bm := roaring.New()
-		if nn, err := bm.ReadFrom(r); err != nil {
-			return n, err
-		} else {
-			n += nn
-		}
-		tm.ReplaceOrInsert(&keyedBitmap{
-			Bitmap:   bm,
-			HighBits: highBits,
-		})
+func (j *jvmSerializer) GetSerializedSizeInBytes() uint64 {
+	return serializedSize(j.tm, FormatJvm)
+}
+
+func (j *jvmSerializer) WriteTo(w io.Writer) (int64, error) {
+	if j.signed {
+		return writeTreeSigned(w, j.tm)
 	}
-	c.tm.tree = tm
-	return
+	return writeTree(w, FormatJvm, j.tm)
 }
 
-type jvmSerializer struct {
-	tm *BTreemap
+func (j *jvmSerializer) ReadFrom(r io.Reader) (int64, error) {
+	tree, signed, n, err := readTree(r, FormatJvm)
+	if err != nil {
+		return n, err
+	}
+	j.tm.tree = tree
+	j.signed = signed
+	return n, nil
 }
 
-func (j *jvmSerializer) GetSerializedSizeInBytes() uint64 {
-	n := 5 + (uint64(j.tm.tree.Len()) * 4)
-	j.tm.forEachBitmap(func(bm *keyedBitmap) bool {
+func serializedSize(tm *BTreemap, format Format) uint64 {
+	n := uint64(format.headerSize()) + (uint64(tm.tree.Len()) * 4)
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
 		n += bm.GetSerializedSizeInBytes()
 		return true
 	})
 	return n
 }
 
-func (j *jvmSerializer) WriteTo(w io.Writer) (int64, error) {
-	if err := binary.Write(w, binary.BigEndian, false); err != nil {
-		return 0, err
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// writeTree reports every byte accepted by w, including the ones before a failed write
+func writeTree(w io.Writer, format Format, tm *BTreemap) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := writeHeader(cw, format, uint64(tm.tree.Len())); err != nil {
+		return cw.n, err
 	}
-	n := int64(1)
+	err := writeBitmaps(cw, format, tm.forEachBitmap)
+	return cw.n, err
+}
 
-	if err := binary.Write(w, binary.BigEndian, uint32(j.tm.tree.Len())); err != nil {
-		return n, err
+// writeTreeSigned writes the jvm layout of a Treemap created with signedLongs=true
+func writeTreeSigned(w io.Writer, tm *BTreemap) (int64, error) {
+	cw := &countingWriter{w: w}
+	if _, err := writeHeaderSigned(cw, FormatJvm, uint64(tm.tree.Len()), true); err != nil {
+		return cw.n, err
 	}
-	n += 4
+	err := writeBitmaps(cw, FormatJvm, tm.forEachBitmapSigned)
+	return cw.n, err
+}
 
+func writeBitmaps(w io.Writer, format Format, forEach func(func(bm *keyedBitmap) bool)) error {
 	var err error
-	j.tm.forEachBitmap(func(bm *keyedBitmap) bool {
-		if err = binary.Write(w, binary.BigEndian, bm.HighBits); err != nil {
-			return false
-		}
-		n += 4
-		nn, er := bm.WriteTo(w)
-		if er != nil {
-			err = er
+	var buf [4]byte
+	forEach(func(bm *keyedBitmap) bool {
+		format.byteOrder().PutUint32(buf[:], bm.HighBits)
+		if _, err = w.Write(buf[:]); err != nil {
 			return false
 		}
-		n += nn
-		return true
+		_, err = bm.WriteTo(w)
+		return err == nil
 	})
-	return n, err
+	return err
 }
 
-func (j *jvmSerializer) ReadFrom(r io.Reader) (n int64, err error) {
-	tm := btree.New(2, nil)
-	var _bl bool
-	if err = binary.Read(r, binary.BigEndian, &_bl); err != nil {
-		return
+// forEachBitmapSigned visits the bitmaps with their high keys in signed int32 order
+func (tm *BTreemap) forEachBitmapSigned(cb func(bm *keyedBitmap) bool) {
+	pivot, cleanup := makeKey(1 << 31)
+	defer cleanup()
+
+	goOn := true
+	tm.tree.AscendGreaterOrEqual(pivot, func(item btree.Item) bool {
+		goOn = cb(item.(*keyedBitmap))
+		return goOn
+	})
+	if goOn {
+		tm.tree.AscendLessThan(pivot, func(item btree.Item) bool {
+			return cb(item.(*keyedBitmap))
+		})
 	}
+}
 
-	var sz uint32
-	if err = binary.Read(r, binary.BigEndian, &sz); err != nil {
-		return
+// readTree reports every byte consumed from r, including the ones before a failed read,
+// and whether a jvm header had the signed-longs flag set
+func readTree(r io.Reader, format Format) (*btree.BTree, bool, int64, error) {
+	keys, signed, n, err := readHeader(r, format)
+	if err != nil {
+		return nil, false, n, err
 	}
+	sr := &StreamReader{r: r, format: format, signed: signed, keys: keys, n: n}
 
-	n = int64(8)
-	for i := uint32(0); i < sz; i++ {
-		var highBits uint32
-		if err = binary.Read(r, binary.BigEndian, &highBits); err != nil {
-			return
+	tree := btree.New(2, nil)
+	for {
+		highBits, bm, err := sr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, sr.BytesRead(), err
 		}
-		n += 4
-		bm := roaring.New()
-		if nn, err := bm.ReadFrom(r); err != nil {
-			return n, err
-		} else {
-			n += nn
+		if bm.IsEmpty() {
+			// CRoaring can write keys that were emptied, they're not kept here
+			continue
 		}
-		tm.ReplaceOrInsert(&keyedBitmap{
+		tree.ReplaceOrInsert(&keyedBitmap{
 			Bitmap:   bm,
 			HighBits: highBits,
 		})
 	}
-	j.tm.tree = tm
-	return
+	return tree, signed, sr.BytesRead(), nil
 }
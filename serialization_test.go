@@ -1,10 +1,20 @@
 package roaring64
 
 import (
-	"github.com/stretchr/testify/require"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"testing"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/stretchr/testify/require"
 )
 
 func TestTreemap_CppSerialize(t *testing.T) {
@@ -40,3 +50,332 @@ func TestTreemap_JvmSerialize(t *testing.T) {
 	require.True(t, tm.Contains(math.MaxUint32))
 	require.True(t, tm.Contains(math.MaxUint64))
 }
+
+func TestTreemap_ReadFromWithOptions(t *testing.T) {
+	tm := New(1, 2, math.MaxUint32, u64(7), math.MaxUint64)
+	data, err := tm.ToBytes()
+	require.NoError(t, err)
+
+	t.Run("valid", func(t *testing.T) {
+		actual := New()
+		n, err := actual.FromBufferWithOptions(data, ReadOptions{MaxKeys: 3, MaxBytes: int64(len(data)), MaxCardinality: 5})
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), n)
+		require.True(t, tm.Equals(actual))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		actual := New(42)
+		_, err := actual.FromBufferWithOptions(data[:len(data)-2], ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+		var de *DecodeError
+		require.True(t, errors.As(err, &de))
+		require.True(t, de.Offset > 8)
+		require.Equal(t, []uint64{42}, actual.ToArray())
+	})
+
+	t.Run("huge key count", func(t *testing.T) {
+		corrupt := append([]byte(nil), data...)
+		binary.LittleEndian.PutUint64(corrupt, math.MaxUint64)
+		_, err := New().FromBufferWithOptions(corrupt, ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+
+		_, err = New().FromBufferWithOptions(corrupt, ReadOptions{MaxKeys: 100})
+		require.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+	})
+
+	t.Run("unordered keys", func(t *testing.T) {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriterN(&buf, FormatCpp, 2)
+		require.NoError(t, err)
+		require.NoError(t, sw.WriteBitmap(1, roaring.BitmapOf(1)))
+		corrupt := buf.Bytes()
+		offset := len(corrupt)
+		corrupt = append(corrupt, corrupt[8:]...)
+
+		_, err = New().FromBufferWithOptions(corrupt, ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+		var de *DecodeError
+		require.True(t, errors.As(err, &de))
+		require.EqualValues(t, offset, de.Offset)
+	})
+
+	t.Run("unsorted container", func(t *testing.T) {
+		var buf bytes.Buffer
+		sw, err := NewStreamWriterN(&buf, FormatCpp, 1)
+		require.NoError(t, err)
+		require.NoError(t, sw.WriteBitmap(1, roaring.BitmapOf(1, 2, 3)))
+		corrupt := buf.Bytes()
+		// header, high key, cookie, container count, key and cardinality, offset
+		values := corrupt[8+4+16:]
+		values[0], values[2] = values[2], values[0]
+
+		_, err = New().FromBufferWithOptions(corrupt, ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	})
+
+	t.Run("run cardinality", func(t *testing.T) {
+		runs := roaring.New()
+		runs.AddRange(10, 1000)
+		runs.RunOptimize()
+		var buf bytes.Buffer
+		sw, err := NewStreamWriterN(&buf, FormatCpp, 1)
+		require.NoError(t, err)
+		require.NoError(t, sw.WriteBitmap(1, runs))
+		corrupt := buf.Bytes()
+		// header, high key, cookie, run flags, key, then the cardinality the runs don't hold
+		binary.LittleEndian.PutUint16(corrupt[8+4+4+1+2:], 4)
+
+		_, err = New().ReadFrom(bytes.NewReader(corrupt))
+		require.NoError(t, err)
+		_, err = New().FromBufferWithOptions(corrupt, ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	})
+
+	t.Run("full run containers", func(t *testing.T) {
+		// 65536 full run containers under one key, a walk over the values takes seconds
+		full := New()
+		full.AddRange(0, 1<<32)
+		full.RunOptimize()
+		data, err := full.ToBytes()
+		require.NoError(t, err)
+		require.Less(t, len(data), 1<<20)
+
+		start := time.Now()
+		actual := New()
+		_, err = actual.FromBufferWithOptions(data, ReadOptions{})
+		require.NoError(t, err)
+		require.Less(t, int64(time.Since(start)), int64(2*time.Second))
+		require.True(t, full.Equals(actual))
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		_, err := New().FromBufferWithOptions(data, ReadOptions{MaxKeys: 2})
+		require.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+		_, err = New().ReadFromWithOptions(bytes.NewReader(data), ReadOptions{MaxBytes: int64(len(data) - 1)})
+		require.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+		_, err = New().FromBufferWithOptions(data, ReadOptions{MaxCardinality: 4})
+		require.True(t, errors.Is(err, ErrLimitExceeded), "%v", err)
+	})
+
+	t.Run("jvm", func(t *testing.T) {
+		f, err := os.Open("_data/testjvm.bin")
+		require.NoError(t, err)
+		defer func() { require.NoError(t, f.Close()) }()
+
+		actual := New().WithJvmSerializer()
+		_, err = actual.ReadFromWithOptions(f, ReadOptions{})
+		require.NoError(t, err)
+		require.True(t, actual.Contains(math.MaxUint64))
+	})
+
+	t.Run("jvm signed", func(t *testing.T) {
+		// a Roaring64NavigableMap with signedLongs=true writes the negative high keys first
+		signed := jvmSignedBytes(1<<31+5, math.MaxUint32, 0, 7)
+		expected := New(joinHiLo(math.MaxUint32, 8), joinHiLo(1<<31+5, 6), joinHiLo(0, 1), joinHiLo(7, 8))
+
+		for _, read := range []func(tm *BTreemap) (int64, error){
+			func(tm *BTreemap) (int64, error) { return tm.FromBufferWithOptions(signed, ReadOptions{}) },
+			func(tm *BTreemap) (int64, error) { return tm.ReadFrom(bytes.NewReader(signed)) },
+		} {
+			actual := New().WithJvmSerializer()
+			n, err := read(actual)
+			require.NoError(t, err)
+			require.EqualValues(t, len(signed), n)
+			require.True(t, expected.Equals(actual))
+
+			written, err := actual.ToBytes()
+			require.NoError(t, err)
+			require.Equal(t, signed, written)
+		}
+
+		written, err := expected.Clone().WithJvmSignedSerializer().ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, signed, written)
+
+		// keys in unsigned order don't match the flag
+		_, err = New().WithJvmSerializer().FromBufferWithOptions(jvmSignedBytes(0, 7, 1<<31+5, math.MaxUint32), ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+
+		flag := append([]byte(nil), signed...)
+		flag[0] = 2
+		_, err = New().WithJvmSerializer().FromBufferWithOptions(flag, ReadOptions{})
+		require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	})
+}
+
+// jvmSignedBytes writes a jvm bitmap with the signed-longs flag set and the high keys in the given order,
+// the bitmap of every key holds 1 + the key modulo 8
+func jvmSignedBytes(keys ...uint32) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(1)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(keys)))
+	for _, hi := range keys {
+		_ = binary.Write(&buf, binary.BigEndian, hi)
+		_, _ = roaring.BitmapOf(1 + hi%8).WriteTo(&buf)
+	}
+	return buf.Bytes()
+}
+
+func randomTreemap(rng *rand.Rand) *BTreemap {
+	tm := New()
+	keys := rng.Intn(8)
+	for k := 0; k < keys; k++ {
+		hi := uint32(rng.Intn(16))
+		if rng.Intn(4) == 0 {
+			hi = math.MaxUint32 - uint32(rng.Intn(4))
+		}
+		switch rng.Intn(3) {
+		case 0:
+			for i := rng.Intn(100); i >= 0; i-- {
+				tm.Add(joinHiLo(hi, rng.Uint32()))
+			}
+		case 1:
+			start := uint64(rng.Intn(1 << 20))
+			tm.AddRange(joinHiLo(hi, uint32(start)), joinHiLo(hi, uint32(start))+uint64(rng.Intn(1<<18)))
+		default:
+			for i := rng.Intn(10000); i >= 0; i-- {
+				tm.Add(joinHiLo(hi, uint32(rng.Intn(1<<17))))
+			}
+		}
+	}
+	if rng.Intn(2) == 0 {
+		tm.RunOptimize()
+	}
+	return tm
+}
+
+type failingWriter struct {
+	left int
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > f.left {
+		n := f.left
+		f.left = 0
+		return n, errors.New("short write")
+	}
+	f.left -= len(p)
+	return len(p), nil
+}
+
+func TestTreemap_SerializedSizes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		tm := randomTreemap(rng)
+		if i%2 == 1 {
+			tm.WithJvmSerializer()
+		}
+
+		data, err := tm.ToBytes()
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), tm.GetSerializedSizeInBytes())
+
+		var buf bytes.Buffer
+		n, err := tm.WriteTo(&buf)
+		require.NoError(t, err)
+		require.EqualValues(t, buf.Len(), n)
+
+		actual := tm.Clone()
+		if i%2 == 1 {
+			actual.WithJvmSerializer()
+		}
+		n, err = actual.ReadFrom(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), n)
+		require.True(t, tm.Equals(actual))
+
+		cut := rng.Intn(len(data))
+		n, err = tm.WriteTo(&failingWriter{left: cut})
+		require.Error(t, err)
+		require.EqualValues(t, cut, n)
+
+		n, err = actual.ReadFrom(bytes.NewReader(data[:cut]))
+		require.Error(t, err)
+		require.EqualValues(t, cut, n)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for file, expected := range map[string]Format{"_data/testcpp.bin": FormatCpp, "_data/testjvm.bin": FormatJvm} {
+		data, err := ioutil.ReadFile(file)
+		require.NoError(t, err)
+
+		format, err := DetectFormat(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, expected, format, file)
+
+		tm, n, err := ReadAny(bufio.NewReader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), n)
+		require.Equal(t, expected, tm.Format())
+		require.True(t, tm.Contains(math.MaxUint64))
+
+		written, err := tm.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, data, written)
+	}
+
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 100; i++ {
+		tm := randomTreemap(rng)
+		if i == 0 {
+			tm = New()
+		}
+		for _, format := range []Format{FormatCpp, FormatJvm} {
+			data, err := tm.WithFormat(format).ToBytes()
+			require.NoError(t, err)
+
+			detected, err := DetectFormat(bytes.NewReader(data))
+			require.NoError(t, err)
+			require.Equal(t, format, detected)
+
+			actual, n, err := ReadAny(bufio.NewReader(bytes.NewReader(data)))
+			require.NoError(t, err)
+			require.EqualValues(t, len(data), n)
+			require.Equal(t, format, actual.Format())
+			require.True(t, tm.Equals(actual))
+		}
+	}
+
+	t.Run("jvm signed", func(t *testing.T) {
+		data := jvmSignedBytes(1<<31+5, math.MaxUint32, 0, 7)
+		detected, err := DetectFormat(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, FormatJvm, detected)
+
+		tm, n, err := ReadAny(bufio.NewReader(bytes.NewReader(data)))
+		require.NoError(t, err)
+		require.EqualValues(t, len(data), n)
+		written, err := tm.ToBytes()
+		require.NoError(t, err)
+		require.Equal(t, data, written)
+	})
+
+	t.Run("back to back", func(t *testing.T) {
+		// an empty jvm bitmap is shorter than the sniffed prefix
+		var stream bytes.Buffer
+		bitmaps := []*BTreemap{New(1, math.MaxUint64).WithJvmSerializer(), New().WithJvmSerializer(), New(7), New()}
+		for _, tm := range bitmaps {
+			_, err := tm.WriteTo(&stream)
+			require.NoError(t, err)
+		}
+
+		r := bufio.NewReader(&stream)
+		for _, expected := range bitmaps {
+			size := expected.GetSerializedSizeInBytes()
+			actual, n, err := ReadAny(r)
+			require.NoError(t, err)
+			require.EqualValues(t, size, n)
+			require.Equal(t, expected.Format(), actual.Format())
+			require.True(t, expected.Equals(actual))
+		}
+		_, err := r.ReadByte()
+		require.Equal(t, io.EOF, err)
+	})
+
+	_, err := DetectFormat(bytes.NewReader([]byte("not a bitmap at all")))
+	require.Equal(t, ErrUnknownFormat, err)
+	_, _, err = ReadAny(bufio.NewReader(bytes.NewReader([]byte("not a bitmap at all"))))
+	require.Equal(t, ErrUnknownFormat, err)
+}
@@ -0,0 +1,64 @@
+package roaring64
+
+import "github.com/RoaringBitmap/roaring"
+
+// The pair API treats a value as (shard, row) = (high 32 bits, low 32 bits),
+// which is exactly how the tree is keyed, so a shard is a single tree lookup.
+
+func (tm *BTreemap) AddPair(shard, row uint32) {
+	tm.getOrInsert(shard).Add(row)
+}
+
+func (tm *BTreemap) ContainsPair(shard, row uint32) bool {
+	return tm.Contains(joinHiLo(shard, row))
+}
+
+func (tm *BTreemap) RemovePair(shard, row uint32) {
+	tm.Remove(joinHiLo(shard, row))
+}
+
+// RowsOf returns a copy of the rows in the shard, it's empty when the shard has none
+func (tm *BTreemap) RowsOf(shard uint32) *roaring.Bitmap {
+	key, cleanup := makeKey(shard)
+	defer cleanup()
+
+	bm, found := tm.get(key)
+	if !found {
+		return roaring.New()
+	}
+	return bm.Bitmap.Clone()
+}
+
+// Shards returns the shards that hold at least one row, in ascending order
+func (tm *BTreemap) Shards() []uint32 {
+	shards := make([]uint32, 0, tm.tree.Len())
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		if !bm.IsEmpty() {
+			shards = append(shards, bm.HighBits)
+		}
+		return true
+	})
+	return shards
+}
+
+// CardinalityOf returns the number of rows in the shard
+func (tm *BTreemap) CardinalityOf(shard uint32) uint64 {
+	key, cleanup := makeKey(shard)
+	defer cleanup()
+
+	bm, found := tm.get(key)
+	if !found {
+		return 0
+	}
+	return bm.GetCardinality()
+}
+
+// RemoveShard drops every row of the shard and reports whether there were any
+func (tm *BTreemap) RemoveShard(shard uint32) bool {
+	key, cleanup := makeKey(shard)
+	defer cleanup()
+
+	tm.invalidate()
+	removed := tm.tree.Delete(key)
+	return removed != nil && !removed.(*keyedBitmap).IsEmpty()
+}
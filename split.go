@@ -0,0 +1,117 @@
+package roaring64
+
+import (
+	"math/bits"
+
+	"github.com/tidwall/btree"
+)
+
+// The split and partition functions move the bitmaps of tm into the results and leave tm empty.
+// Keys that land in one result move as they are, a key that has to be cut shares its containers
+// between both halves and only the container holding the cut is copied.
+
+// SplitAt moves the values below v into lower and the others into upper
+func (tm *BTreemap) SplitAt(v uint64) (lower, upper *BTreemap) {
+	lower, upper = New(), New()
+	hi, lo := splitHiLo(v)
+	tm.drain(func(bm *keyedBitmap) {
+		switch {
+		case bm.HighBits < hi:
+			lower.tree.ReplaceOrInsert(bm)
+		case bm.HighBits > hi || lo == 0:
+			upper.tree.ReplaceOrInsert(bm)
+		default:
+			below, rest := cutKey(bm, lo)
+			lower.insertNonEmpty(below)
+			upper.insertNonEmpty(rest)
+		}
+	})
+	return lower, upper
+}
+
+// PartitionByCardinality moves the values into n bitmaps of consecutive values whose
+// cardinalities differ by at most one, it returns nil when n is below 1
+func (tm *BTreemap) PartitionByCardinality(n int) []*BTreemap {
+	if n < 1 {
+		return nil
+	}
+	parts := make([]*BTreemap, n)
+	for i := range parts {
+		parts[i] = New()
+	}
+	card := tm.GetCardinality()
+	// part p holds the ranks in [boundary(p), boundary(p+1))
+	boundary := func(p int) uint64 {
+		hi, lo := bits.Mul64(uint64(p), card)
+		q, _ := bits.Div64(hi, lo, uint64(n))
+		return q
+	}
+
+	p, end := 0, boundary(1)
+	var before uint64
+	tm.drain(func(bm *keyedBitmap) {
+		after := before + bm.GetCardinality()
+		for p < n-1 && after > end {
+			// the part ends inside this key, cut it at the value of rank end
+			var below *keyedBitmap
+			if end > before {
+				lo, _ := bm.Select(uint32(end - before))
+				below, bm = cutKey(bm, lo)
+				before = end
+			}
+			parts[p].insertNonEmpty(below)
+			p++
+			end = boundary(p + 1)
+		}
+		parts[p].insertNonEmpty(bm)
+		before = after
+	})
+	return parts
+}
+
+// PartitionByHighBits moves every high key into the bitmap at index partition(hi),
+// the result is as long as the largest index returned, keys with a negative index are dropped
+func (tm *BTreemap) PartitionByHighBits(partition func(hi uint32) int) []*BTreemap {
+	var parts []*BTreemap
+	tm.drain(func(bm *keyedBitmap) {
+		p := partition(bm.HighBits)
+		if p < 0 {
+			return
+		}
+		for len(parts) <= p {
+			parts = append(parts, New())
+		}
+		parts[p].tree.ReplaceOrInsert(bm)
+	})
+	return parts
+}
+
+// drain calls cb with every non-empty bitmap in key order and leaves tm empty
+func (tm *BTreemap) drain(cb func(bm *keyedBitmap)) {
+	tree := tm.tree
+	tm.tree = btree.New(2, nil)
+	tree.Ascend(func(i btree.Item) bool {
+		if bm := i.(*keyedBitmap); !bm.IsEmpty() {
+			cb(bm)
+		}
+		return true
+	})
+}
+
+// cutKey splits bm into the values below lo and the others, reusing bm for the upper half.
+// With copy on write the lower half shares every container and only the one holding lo is copied.
+func cutKey(bm *keyedBitmap, lo uint32) (below, rest *keyedBitmap) {
+	bm.SetCopyOnWrite(true)
+	lower := bm.Bitmap.Clone()
+	lower.RemoveRange(uint64(lo), 1<<32)
+	bm.RemoveRange(0, uint64(lo))
+	lower.SetCopyOnWrite(false)
+	bm.SetCopyOnWrite(false)
+	return &keyedBitmap{Bitmap: lower, HighBits: bm.HighBits}, bm
+}
+
+func (tm *BTreemap) insertNonEmpty(bm *keyedBitmap) {
+	if bm != nil && !bm.IsEmpty() {
+		tm.tree.ReplaceOrInsert(bm)
+	}
+}
@@ -0,0 +1,62 @@
+package roaring64
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+)
+
+// Value stores the bitmap as bytes in the format of the configured serializer,
+// e.g. in a Postgres bytea or a SQLite blob column.
+func (tm *BTreemap) Value() (driver.Value, error) {
+	return tm.ToBytes()
+}
+
+// Scan reads a bitmap written by Value, in the format of the configured serializer.
+// A zero value BTreemap scans the cpp format. The input is validated and a corrupt column
+// leaves the bitmap untouched and returns a *DecodeError.
+func (tm *BTreemap) Scan(src interface{}) error {
+	tm.init()
+	switch data := src.(type) {
+	case []byte:
+		_, err := tm.FromBufferWithOptions(data, ReadOptions{})
+		return err
+	case string:
+		_, err := tm.FromBufferWithOptions([]byte(data), ReadOptions{})
+		return err
+	case nil:
+		return errors.New("can't scan NULL into a BTreemap, use NullBTreemap")
+	default:
+		return fmt.Errorf("can't scan %T into a BTreemap", src)
+	}
+}
+
+// NullBTreemap is a BTreemap that may be NULL, like sql.NullString.
+// When BTreemap is set before scanning, its serializer decides the format that is read.
+type NullBTreemap struct {
+	BTreemap *BTreemap
+	Valid    bool
+}
+
+func (n *NullBTreemap) Scan(src interface{}) error {
+	if src == nil {
+		n.BTreemap, n.Valid = nil, false
+		return nil
+	}
+	tm := n.BTreemap
+	if tm == nil {
+		tm = New()
+	}
+	if err := tm.Scan(src); err != nil {
+		return err
+	}
+	n.BTreemap, n.Valid = tm, true
+	return nil
+}
+
+func (n NullBTreemap) Value() (driver.Value, error) {
+	if !n.Valid || n.BTreemap == nil {
+		return nil, nil
+	}
+	return n.BTreemap.Value()
+}
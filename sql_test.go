@@ -0,0 +1,125 @@
+package roaring64
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDriver is a single column table: exec with one argument appends a row,
+// any query returns every row.
+type fakeDriver struct {
+	mu   sync.Mutex
+	rows []driver.Value
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) { return &fakeStmt{c.d}, nil }
+func (c *fakeConn) Close() error                        { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)           { return nil, errors.New("no transactions") }
+
+type fakeStmt struct{ d *fakeDriver }
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.rows = append(s.d.rows, args[0])
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	return &fakeRows{rows: append([]driver.Value(nil), s.d.rows...)}, nil
+}
+
+type fakeRows struct {
+	rows []driver.Value
+	pos  int
+}
+
+func (r *fakeRows) Columns() []string { return []string{"ids"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	dest[0] = r.rows[r.pos]
+	r.pos++
+	return nil
+}
+
+func openFakeDB(t *testing.T, name string) *sql.DB {
+	sql.Register(name, &fakeDriver{})
+	db, err := sql.Open(name, "")
+	require.NoError(t, err)
+	return db
+}
+
+func TestTreemap_SQL(t *testing.T) {
+	db := openFakeDB(t, "roaring64-sql")
+	defer func() { require.NoError(t, db.Close()) }()
+
+	cpp := New(1, 2, math.MaxUint32, math.MaxUint64)
+	jvm := New(3, math.MaxUint64).WithJvmSerializer()
+	_, err := db.Exec("INSERT INTO segments VALUES (?)", cpp)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO segments VALUES (?)", jvm)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO segments VALUES (?)", NullBTreemap{})
+	require.NoError(t, err)
+
+	rows, err := db.Query("SELECT ids FROM segments")
+	require.NoError(t, err)
+	defer func() { require.NoError(t, rows.Close()) }()
+
+	var first BTreemap
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&first))
+	require.True(t, cpp.Equals(&first))
+
+	second := NullBTreemap{BTreemap: New().WithJvmSerializer()}
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&second))
+	require.True(t, second.Valid)
+	require.True(t, jvm.Equals(second.BTreemap))
+
+	var third NullBTreemap
+	require.True(t, rows.Next())
+	require.NoError(t, rows.Scan(&third))
+	require.False(t, third.Valid)
+	require.Nil(t, third.BTreemap)
+
+	require.False(t, rows.Next())
+	require.NoError(t, rows.Err())
+}
+
+func TestTreemap_ScanCorrupt(t *testing.T) {
+	data, err := New(1, 2, math.MaxUint64).ToBytes()
+	require.NoError(t, err)
+
+	tm := New(42)
+	err = tm.Scan(data[:len(data)-1])
+	require.True(t, errors.Is(err, ErrCorrupt), "%v", err)
+	require.Equal(t, []uint64{42}, tm.ToArray())
+
+	require.Error(t, tm.Scan(nil))
+	require.Error(t, tm.Scan(12))
+
+	var null NullBTreemap
+	require.Error(t, null.Scan(data[:len(data)-1]))
+	require.False(t, null.Valid)
+}
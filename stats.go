@@ -0,0 +1,105 @@
+package roaring64
+
+import (
+	"math/bits"
+	"unsafe"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+const (
+	// the tree is created with btree.New(2, nil)
+	treeDegree = 2
+	// a btree node holds an items slice, a children slice and a copy-on-write pointer
+	treeNodeBytes = 3*8 + 3*8 + 8
+	// every item is stored as an interface value, every child as a pointer
+	treeItemBytes  = 16
+	treeChildBytes = 8
+)
+
+// Stats64 describes a BTreemap at the 64-bit level, on top of the container totals of roaring.Statistics.
+type Stats64 struct {
+	// totals over every key
+	roaring.Statistics
+
+	// Keys is the number of high keys held in the btree, EmptyKeys how many of them hold no values
+	Keys      uint64
+	EmptyKeys uint64
+
+	// TreeDepthBound is an upper bound computed from the key count, the deepest a btree with this many keys
+	// can be. It isn't measured on this tree, which may be shallower.
+	TreeDepthBound int
+	// TreeOverheadBytes estimates the memory used by the btree nodes and the per-key bookkeeping,
+	// on top of the containers
+	TreeOverheadBytes uint64
+	// KeyOverheadBytes estimates the memory every high key costs besides its containers
+	KeyOverheadBytes uint64
+
+	// CardinalityHistogram counts the non-empty keys by cardinality,
+	// bucket i holds the keys with a cardinality in [2^i, 2^(i+1))
+	CardinalityHistogram [33]uint64
+
+	// PerKey holds the statistics of every high key, it's only filled when requested
+	PerKey map[uint32]roaring.Statistics
+}
+
+func addStatistics(dst *roaring.Statistics, st roaring.Statistics) {
+	dst.Cardinality += st.Cardinality
+	dst.Containers += st.Containers
+
+	dst.ArrayContainers += st.ArrayContainers
+	dst.ArrayContainerBytes += st.ArrayContainerBytes
+	dst.ArrayContainerValues += st.ArrayContainerValues
+
+	dst.BitmapContainers += st.BitmapContainers
+	dst.BitmapContainerBytes += st.BitmapContainerBytes
+	dst.BitmapContainerValues += st.BitmapContainerValues
+
+	dst.RunContainers += st.RunContainers
+	dst.RunContainerBytes += st.RunContainerBytes
+	dst.RunContainerValues += st.RunContainerValues
+}
+
+// treeDepthBound is the height of a btree of the given degree where every node holds the minimum number of items
+func treeDepthBound(keys uint64, degree uint64) int {
+	if keys == 0 {
+		return 0
+	}
+	// the root holds at least 1 item, every other node at least degree-1 items and degree children
+	depth := 1
+	for reach, nodes := uint64(1), uint64(2); reach < keys; depth++ {
+		reach += nodes * (degree - 1)
+		nodes *= degree
+	}
+	return depth
+}
+
+// Stats64 computes statistics for capacity planning, perKey includes the statistics of every high key.
+func (tm *BTreemap) Stats64(perKey bool) Stats64 {
+	var stats Stats64
+	if perKey {
+		stats.PerKey = make(map[uint32]roaring.Statistics, tm.tree.Len())
+	}
+
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		st := bm.Bitmap.Stats()
+		addStatistics(&stats.Statistics, st)
+		stats.Keys++
+		if st.Cardinality == 0 {
+			stats.EmptyKeys++
+		} else {
+			stats.CardinalityHistogram[bits.Len64(st.Cardinality)-1]++
+		}
+		if perKey {
+			stats.PerKey[bm.HighBits] = st
+		}
+		return true
+	})
+
+	stats.TreeDepthBound = treeDepthBound(stats.Keys, treeDegree)
+	stats.KeyOverheadBytes = uint64(unsafe.Sizeof(keyedBitmap{})) + uint64(unsafe.Sizeof(roaring.Bitmap{})) + treeItemBytes
+	// nodes are at least half full, so there is at most one node per degree-1 keys
+	nodes := (stats.Keys + treeDegree - 2) / (treeDegree - 1)
+	stats.TreeOverheadBytes = stats.Keys*stats.KeyOverheadBytes + nodes*(treeNodeBytes+treeChildBytes)
+	return stats
+}
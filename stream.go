@@ -0,0 +1,295 @@
+package roaring64
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Format identifies one of the supported 64-bit serialization layouts.
+type Format int
+
+const (
+	// FormatCpp is the layout of CRoaring's Roaring64Map: a little-endian uint64 key count,
+	// followed by a little-endian uint32 high key and a portable 32-bit bitmap per key.
+	FormatCpp Format = iota
+	// FormatJvm is the layout of Java's Roaring64NavigableMap: a signed-longs flag byte,
+	// a big-endian uint32 key count, followed by a big-endian uint32 high key and a portable 32-bit bitmap per key.
+	FormatJvm
+
+	// FormatPortable is the 64-bit layout of the RoaringFormatSpec, which is what CRoaring writes
+	FormatPortable = FormatCpp
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatCpp:
+		return "cpp"
+	case FormatJvm:
+		return "jvm"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+func (f Format) byteOrder() binary.ByteOrder {
+	if f == FormatJvm {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (f Format) headerSize() int64 {
+	if f == FormatJvm {
+		return 5
+	}
+	return 8
+}
+
+func (f Format) valid() bool {
+	return f == FormatCpp || f == FormatJvm
+}
+
+// keyLess reports whether high key a is written before b,
+// a jvm bitmap written with signedLongs=true orders its high keys as signed int32
+func keyLess(signed bool, a, b uint32) bool {
+	if signed {
+		return int32(a) < int32(b)
+	}
+	return a < b
+}
+
+func writeHeader(w io.Writer, format Format, keys uint64) (int64, error) {
+	return writeHeaderSigned(w, format, keys, false)
+}
+
+// writeHeaderSigned sets the signed-longs flag of a jvm header, it's ignored for other formats
+func writeHeaderSigned(w io.Writer, format Format, keys uint64, signed bool) (int64, error) {
+	var buf [8]byte
+	switch format {
+	case FormatCpp:
+		binary.LittleEndian.PutUint64(buf[:], keys)
+	case FormatJvm:
+		if keys > math.MaxUint32 {
+			return 0, fmt.Errorf("jvm format can't hold %d keys", keys)
+		}
+		if signed {
+			buf[0] = 1
+		}
+		binary.BigEndian.PutUint32(buf[1:], uint32(keys))
+	default:
+		return 0, fmt.Errorf("unknown serialization format %v", format)
+	}
+	n, err := w.Write(buf[:format.headerSize()])
+	return int64(n), err
+}
+
+// readHeader returns the key count and, for a jvm header, whether the signed-longs flag is set
+func readHeader(r io.Reader, format Format) (uint64, bool, int64, error) {
+	if !format.valid() {
+		return 0, false, 0, fmt.Errorf("unknown serialization format %v", format)
+	}
+	var buf [8]byte
+	n, err := io.ReadFull(r, buf[:format.headerSize()])
+	if err != nil {
+		return 0, false, int64(n), err
+	}
+	if format == FormatJvm {
+		if buf[0] > 1 {
+			return 0, false, int64(n), fmt.Errorf("invalid signed-longs flag %d", buf[0])
+		}
+		return uint64(binary.BigEndian.Uint32(buf[1:])), buf[0] == 1, int64(n), nil
+	}
+	return binary.LittleEndian.Uint64(buf[:]), false, int64(n), nil
+}
+
+// ErrStreamClosed is returned when writing to a StreamWriter after Close
+var ErrStreamClosed = errors.New("stream writer is closed")
+
+// StreamWriter serializes a 64-bit bitmap one high key at a time, so the whole
+// bitmap never has to be held in memory. The output is byte-identical to what
+// WriteTo produces for the same content and format.
+type StreamWriter struct {
+	w      *countingWriter
+	format Format
+
+	// seekable writers get the key count patched in on Close,
+	// otherwise the count has to be declared up front
+	seeker   io.WriteSeeker
+	start    int64
+	declared uint64
+
+	keys    uint64
+	lastKey uint32
+	err     error
+	closed  bool
+}
+
+// NewStreamWriter starts a stream on a seekable writer.
+// A placeholder key count is written immediately and patched with the real count on Close.
+func NewStreamWriter(w io.WriteSeeker, format Format) (*StreamWriter, error) {
+	start, err := w.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	sw := &StreamWriter{w: &countingWriter{w: w}, format: format, seeker: w, start: start}
+	if _, err = writeHeader(sw.w, format, 0); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// NewStreamWriterN starts a stream on a plain writer for a bitmap with exactly keys high keys.
+// Close fails when a different number of keys was written.
+func NewStreamWriterN(w io.Writer, format Format, keys uint64) (*StreamWriter, error) {
+	sw := &StreamWriter{w: &countingWriter{w: w}, format: format, declared: keys}
+	if _, err := writeHeader(sw.w, format, keys); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// WriteBitmap appends the bitmap for the given high bits.
+// High keys must be written in strictly increasing order.
+func (s *StreamWriter) WriteBitmap(highBits uint32, bm *roaring.Bitmap) error {
+	if s.closed {
+		return ErrStreamClosed
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if s.keys > 0 && highBits <= s.lastKey {
+		return fmt.Errorf("high key %d written after %d, keys must be strictly increasing", highBits, s.lastKey)
+	}
+	if s.seeker == nil && s.keys >= s.declared {
+		return fmt.Errorf("stream was declared with %d keys", s.declared)
+	}
+
+	var buf [4]byte
+	s.format.byteOrder().PutUint32(buf[:], highBits)
+	if _, err := s.w.Write(buf[:]); err != nil {
+		s.err = err
+		return err
+	}
+	if _, err := bm.WriteTo(s.w); err != nil {
+		s.err = err
+		return err
+	}
+	s.keys++
+	s.lastKey = highBits
+	return nil
+}
+
+// WriteTreemap appends every key of the treemap, all of them must be greater than the keys written so far.
+func (s *StreamWriter) WriteTreemap(tm *BTreemap) error {
+	var err error
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		err = s.WriteBitmap(bm.HighBits, bm.Bitmap)
+		return err == nil
+	})
+	return err
+}
+
+// Len returns the number of high keys written so far
+func (s *StreamWriter) Len() uint64 {
+	return s.keys
+}
+
+// BytesWritten returns the number of bytes written so far, including the header
+func (s *StreamWriter) BytesWritten() int64 {
+	return s.w.n
+}
+
+// Close finishes the stream. It does not close the underlying writer.
+func (s *StreamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if s.err != nil {
+		return s.err
+	}
+
+	if s.seeker == nil {
+		if s.keys != s.declared {
+			return fmt.Errorf("stream was declared with %d keys but %d were written", s.declared, s.keys)
+		}
+		return nil
+	}
+
+	if _, err := s.seeker.Seek(s.start, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := writeHeader(s.seeker, s.format, s.keys); err != nil {
+		return err
+	}
+	_, err := s.seeker.Seek(s.start+s.w.n, io.SeekStart)
+	return err
+}
+
+// StreamReader reads a serialized 64-bit bitmap as a sequence of (high bits, bitmap) pairs
+// without materializing the whole bitmap.
+type StreamReader struct {
+	r      io.Reader
+	format Format
+	signed bool
+	keys   uint64
+	read   uint64
+	n      int64
+}
+
+// NewStreamReader reads the header of the stream.
+func NewStreamReader(r io.Reader, format Format) (*StreamReader, error) {
+	keys, signed, n, err := readHeader(r, format)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{r: r, format: format, signed: signed, keys: keys, n: n}, nil
+}
+
+// SignedLongs reports whether a jvm stream was written by a Roaring64NavigableMap with signedLongs=true,
+// its high keys are then ordered as signed int32 so keys with the top bit set come first.
+func (s *StreamReader) SignedLongs() bool {
+	return s.signed
+}
+
+// Len returns the number of high keys announced by the header
+func (s *StreamReader) Len() uint64 {
+	return s.keys
+}
+
+// BytesRead returns the number of bytes consumed so far, including the header
+func (s *StreamReader) BytesRead() int64 {
+	return s.n
+}
+
+// Next returns the next high key and its bitmap, or io.EOF once every announced key was read.
+func (s *StreamReader) Next() (uint32, *roaring.Bitmap, error) {
+	if s.read >= s.keys {
+		return 0, nil, io.EOF
+	}
+
+	var buf [4]byte
+	nn, err := io.ReadFull(s.r, buf[:])
+	s.n += int64(nn)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	highBits := s.format.byteOrder().Uint32(buf[:])
+
+	bm := roaring.New()
+	read, err := bm.ReadFrom(s.r)
+	s.n += read
+	if err != nil {
+		return 0, nil, err
+	}
+	s.read++
+	return highBits, bm, nil
+}
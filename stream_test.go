@@ -0,0 +1,126 @@
+package roaring64
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func streamFixture() *BTreemap {
+	tm := New(1, 2, 3, math.MaxUint32, math.MaxUint64)
+	for i := uint64(100); i < 1000; i++ {
+		tm.Add(u64(uint32(i)))
+	}
+	return tm
+}
+
+func TestStreamWriter_Seekable(t *testing.T) {
+	for _, format := range []Format{FormatCpp, FormatJvm} {
+		t.Run(format.String(), func(t *testing.T) {
+			tm := streamFixture()
+			if format == FormatJvm {
+				tm.WithJvmSerializer()
+			}
+			expected, err := tm.ToBytes()
+			require.NoError(t, err)
+
+			f, err := ioutil.TempFile("", "roaring64-stream")
+			require.NoError(t, err)
+			defer func() { _ = os.Remove(f.Name()) }()
+			defer func() { _ = f.Close() }()
+
+			sw, err := NewStreamWriter(f, format)
+			require.NoError(t, err)
+			tm.forEachBitmap(func(bm *keyedBitmap) bool {
+				require.NoError(t, sw.WriteBitmap(bm.HighBits, bm.Bitmap))
+				return true
+			})
+			require.NoError(t, sw.Close())
+			require.EqualValues(t, len(expected), sw.BytesWritten())
+
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			actual, err := ioutil.ReadAll(f)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestStreamWriter_Declared(t *testing.T) {
+	tm := streamFixture()
+	expected, err := tm.ToBytes()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	sw, err := NewStreamWriterN(&buf, FormatCpp, uint64(tm.tree.Len()))
+	require.NoError(t, err)
+	require.NoError(t, sw.WriteTreemap(tm))
+	require.NoError(t, sw.Close())
+	require.Equal(t, expected, buf.Bytes())
+
+	sw, err = NewStreamWriterN(ioutil.Discard, FormatCpp, 2)
+	require.NoError(t, err)
+	require.NoError(t, sw.WriteBitmap(1, New(1).tree.Min().(*keyedBitmap).Bitmap))
+	require.Error(t, sw.Close())
+	require.Equal(t, ErrStreamClosed, sw.WriteBitmap(2, nil))
+}
+
+func TestStreamWriter_KeyOrder(t *testing.T) {
+	sw, err := NewStreamWriterN(ioutil.Discard, FormatCpp, 3)
+	require.NoError(t, err)
+	bm := New(1).tree.Min().(*keyedBitmap).Bitmap
+	require.NoError(t, sw.WriteBitmap(5, bm))
+	require.Error(t, sw.WriteBitmap(5, bm))
+	require.Error(t, sw.WriteBitmap(4, bm))
+	require.NoError(t, sw.WriteBitmap(6, bm))
+}
+
+func TestStreamReader(t *testing.T) {
+	for _, format := range []Format{FormatCpp, FormatJvm} {
+		t.Run(format.String(), func(t *testing.T) {
+			tm := streamFixture()
+			if format == FormatJvm {
+				tm.WithJvmSerializer()
+			}
+			data, err := tm.ToBytes()
+			require.NoError(t, err)
+
+			sr, err := NewStreamReader(bytes.NewReader(data), format)
+			require.NoError(t, err)
+			require.EqualValues(t, tm.tree.Len(), sr.Len())
+
+			actual := New()
+			for {
+				hi, bm, err := sr.Next()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(t, err)
+				actual.tree.ReplaceOrInsert(&keyedBitmap{HighBits: hi, Bitmap: bm})
+			}
+			require.True(t, tm.Equals(actual))
+			require.EqualValues(t, len(data), sr.BytesRead())
+		})
+	}
+}
+
+func TestStreamReader_Truncated(t *testing.T) {
+	data, err := streamFixture().ToBytes()
+	require.NoError(t, err)
+
+	sr, err := NewStreamReader(bytes.NewReader(data[:len(data)-3]), FormatCpp)
+	require.NoError(t, err)
+	for {
+		_, _, err = sr.Next()
+		if err != nil {
+			break
+		}
+	}
+	require.NotEqual(t, io.EOF, err)
+}
@@ -0,0 +1,224 @@
+package roaring64
+
+import (
+	"container/heap"
+	"math/bits"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Threshold returns the values that occur in at least t of the bitmaps, t below 1 counts as 1.
+// Every high key is aggregated on its own, and keys present in fewer than t bitmaps are skipped
+// without looking at their values.
+func Threshold(t int, bitmaps ...*BTreemap) *BTreemap {
+	answer := New()
+	if t < 1 {
+		t = 1
+	}
+	if t > len(bitmaps) {
+		return answer
+	}
+	forEachKeyGroup(bitmaps, func(highBits uint32, group []*roaring.Bitmap) {
+		if len(group) < t {
+			return
+		}
+		var bm *roaring.Bitmap
+		switch t {
+		case 1:
+			bm = roaring.FastOr(group...)
+		case len(group):
+			bm = roaring.FastAnd(group...)
+		default:
+			bm = atLeast(countBitmaps(group), t)
+		}
+		if !bm.IsEmpty() {
+			answer.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm, HighBits: highBits})
+		}
+	})
+	return answer
+}
+
+// Occurrences holds, for every value, the number of bitmaps it occurs in.
+// The counts are a bit-sliced index per high key: bit j of a count is set when the value is in slice j.
+type Occurrences struct {
+	keys []keyCounter
+}
+
+type keyCounter struct {
+	highBits uint32
+	slices   []*roaring.Bitmap
+}
+
+// CountOccurrences counts in how many of the bitmaps every value occurs
+func CountOccurrences(bitmaps ...*BTreemap) *Occurrences {
+	occ := &Occurrences{}
+	forEachKeyGroup(bitmaps, func(highBits uint32, group []*roaring.Bitmap) {
+		occ.keys = append(occ.keys, keyCounter{highBits: highBits, slices: countBitmaps(group)})
+	})
+	return occ
+}
+
+// Count returns the number of bitmaps holding v
+func (o *Occurrences) Count(v uint64) int {
+	hi, lo := splitHiLo(v)
+	i := sort.Search(len(o.keys), func(i int) bool { return o.keys[i].highBits >= hi })
+	if i == len(o.keys) || o.keys[i].highBits != hi {
+		return 0
+	}
+	count := 0
+	for j, slice := range o.keys[i].slices {
+		if slice.Contains(lo) {
+			count |= 1 << uint(j)
+		}
+	}
+	return count
+}
+
+// AtLeast returns the values that occur in t or more bitmaps, t below 1 counts as 1
+func (o *Occurrences) AtLeast(t int) *BTreemap {
+	answer := New()
+	for _, key := range o.keys {
+		if bm := atLeast(key.slices, t); !bm.IsEmpty() {
+			answer.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm, HighBits: key.highBits})
+		}
+	}
+	return answer
+}
+
+// Exactly returns the values that occur in exactly t bitmaps
+func (o *Occurrences) Exactly(t int) *BTreemap {
+	answer := New()
+	if t < 1 {
+		return answer
+	}
+	for _, key := range o.keys {
+		bm := roaring.AndNot(atLeast(key.slices, t), atLeast(key.slices, t+1))
+		if !bm.IsEmpty() {
+			answer.tree.ReplaceOrInsert(&keyedBitmap{Bitmap: bm, HighBits: key.highBits})
+		}
+	}
+	return answer
+}
+
+// BitSlices returns the bit-sliced index itself: a value occurs in
+// sum(1<<j for every slice j holding it) bitmaps
+func (o *Occurrences) BitSlices() []*BTreemap {
+	var slices []*BTreemap
+	for _, key := range o.keys {
+		for j, slice := range key.slices {
+			for len(slices) <= j {
+				slices = append(slices, New())
+			}
+			if !slice.IsEmpty() {
+				slices[j].tree.ReplaceOrInsert(&keyedBitmap{Bitmap: slice.Clone(), HighBits: key.highBits})
+			}
+		}
+	}
+	return slices
+}
+
+// Iterate calls cb with every value that occurs at least once and its count, in ascending order
+func (o *Occurrences) Iterate(cb func(v uint64, count int) bool) {
+	for _, key := range o.keys {
+		it := roaring.FastOr(key.slices...).Iterator()
+		for it.HasNext() {
+			lo := it.Next()
+			count := 0
+			for j, slice := range key.slices {
+				if slice.Contains(lo) {
+					count |= 1 << uint(j)
+				}
+			}
+			if !cb(joinHiLo(key.highBits, lo), count) {
+				return
+			}
+		}
+	}
+}
+
+// countBitmaps adds the bitmaps into a binary counter made of bitmaps, slice j holding bit j of the counts
+func countBitmaps(group []*roaring.Bitmap) []*roaring.Bitmap {
+	var slices []*roaring.Bitmap
+	for _, bm := range group {
+		carry := bm
+		for j := 0; !carry.IsEmpty(); j++ {
+			if j == len(slices) {
+				slices = append(slices, carry.Clone())
+				break
+			}
+			// the copying operations, the in-place Xor is quadratic when it empties containers
+			next := roaring.And(slices[j], carry)
+			slices[j] = roaring.Xor(slices[j], carry)
+			carry = next
+		}
+	}
+	return slices
+}
+
+// atLeast compares the counts of a bit-sliced counter against t from the most significant slice down
+func atLeast(slices []*roaring.Bitmap, t int) *roaring.Bitmap {
+	if t < 1 {
+		t = 1
+	}
+	if bits.Len(uint(t)) > len(slices) {
+		return roaring.New()
+	}
+	equal := roaring.FastOr(slices...)
+	greater := roaring.New()
+	for j := len(slices) - 1; j >= 0; j-- {
+		if t&(1<<uint(j)) != 0 {
+			equal = roaring.And(equal, slices[j])
+		} else {
+			greater = roaring.Or(greater, roaring.And(equal, slices[j]))
+			equal = roaring.AndNot(equal, slices[j])
+		}
+	}
+	return roaring.Or(greater, equal)
+}
+
+// forEachKeyGroup merges the keys of all bitmaps and calls cb once per high key
+// with the 32-bit bitmaps that have it. The group slice is reused between calls.
+func forEachKeyGroup(bitmaps []*BTreemap, cb func(highBits uint32, group []*roaring.Bitmap)) {
+	walkers := make(walkerHeap, 0, len(bitmaps))
+	for _, tm := range bitmaps {
+		if w := newKeyWalker(tm); w.bm != nil {
+			walkers = append(walkers, w)
+		}
+	}
+	heap.Init(&walkers)
+
+	var group []*roaring.Bitmap
+	for walkers.Len() > 0 {
+		highBits := walkers[0].bm.HighBits
+		group = group[:0]
+		for walkers.Len() > 0 && walkers[0].bm.HighBits == highBits {
+			w := walkers[0]
+			group = append(group, w.bm.Bitmap)
+			if w.next(); w.bm == nil {
+				heap.Pop(&walkers)
+			} else {
+				heap.Fix(&walkers, 0)
+			}
+		}
+		cb(highBits, group)
+	}
+}
+
+// walkerHeap orders key walkers by their current high key
+type walkerHeap []*keyWalker
+
+func (h walkerHeap) Len() int { return len(h) }
+
+func (h walkerHeap) Less(i, j int) bool { return h[i].bm.HighBits < h[j].bm.HighBits }
+
+func (h walkerHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *walkerHeap) Push(x interface{}) { *h = append(*h, x.(*keyWalker)) }
+
+func (h *walkerHeap) Pop() interface{} {
+	old := *h
+	w := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return w
+}
@@ -2,8 +2,11 @@ package roaring64
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
 	"strconv"
 	"testing"
 
@@ -329,3 +332,669 @@ func TestSmoke(t *testing.T) {
 		t.Errorf("Bad read: %v != %v", rb1.ToArray(), nwewrb.ToArray())
 	}
 }
+
+func TestTreemap_Stats(t *testing.T) {
+	bm := New(1, 2, 3, u64(1), math.MaxUint64)
+	bm.AddRange(joinHiLo(1, 1<<16), joinHiLo(1, 3<<16))
+
+	st := bm.Stats()
+	require.EqualValues(t, bm.GetCardinality(), st.Cardinality)
+	require.EqualValues(t, 3, st.ArrayContainers)
+	require.EqualValues(t, 5, st.ArrayContainerValues)
+	require.EqualValues(t, 2, st.RunContainers)
+	require.EqualValues(t, 2<<16, st.RunContainerValues)
+	require.EqualValues(t, 5, st.Containers)
+
+	st64 := bm.Stats64(true)
+	require.Equal(t, st, st64.Statistics)
+	require.EqualValues(t, 3, st64.Keys)
+	require.EqualValues(t, 0, st64.EmptyKeys)
+	require.EqualValues(t, 1, st64.CardinalityHistogram[0])
+	require.EqualValues(t, 1, st64.CardinalityHistogram[1])
+	require.EqualValues(t, 1, st64.CardinalityHistogram[17])
+	require.Len(t, st64.PerKey, 3)
+	require.EqualValues(t, 2<<16+1, st64.PerKey[1].Cardinality)
+	require.EqualValues(t, 2, st64.TreeDepthBound)
+	require.True(t, st64.TreeOverheadBytes >= 3*st64.KeyOverheadBytes)
+
+	require.Nil(t, New().Stats64(false).PerKey)
+	require.Zero(t, New().Stats64(false).TreeDepthBound)
+}
+
+func TestTreemap_ValidateAfterMutations(t *testing.T) {
+	bm := New(1, 2, u64(3), math.MaxUint64)
+	bm.Clear()
+	require.NoError(t, bm.Validate())
+	require.EqualValues(t, 0, bm.Minimum())
+	require.True(t, bm.Equals(New()))
+
+	bm = New(1, 2, u64(3), math.MaxUint64)
+	bm.AndNot(New(u64(3), math.MaxUint64))
+	require.NoError(t, bm.Validate())
+	require.True(t, bm.Equals(New(1, 2)))
+	require.EqualValues(t, 2, bm.Maximum())
+
+	bm = New(1, u64(3), math.MaxUint64)
+	bm.RemoveRange(2, math.MaxUint64)
+	require.NoError(t, bm.Validate())
+	require.Equal(t, []uint64{1, math.MaxUint64}, bm.ToArray())
+
+	bm.RemoveRange(0, math.MaxUint64)
+	bm.Remove(math.MaxUint64)
+	require.NoError(t, bm.Validate())
+	require.True(t, bm.IsEmpty())
+
+	bm = New()
+	bm.Flip(math.MaxUint32-1, math.MaxUint32+2)
+	require.Equal(t, []uint64{math.MaxUint32 - 1, math.MaxUint32, math.MaxUint32 + 1}, bm.ToArray())
+	bm.Flip(math.MaxUint32-1, math.MaxUint32+2)
+	require.NoError(t, bm.Validate())
+	require.True(t, bm.Equals(New()))
+
+	bm = New()
+	bm.AddRange(1<<32-1, 3<<32+1)
+	require.EqualValues(t, 2<<32+2, bm.GetCardinality())
+	require.EqualValues(t, 1<<32-1, bm.Minimum())
+	require.EqualValues(t, 3<<32, bm.Maximum())
+	bm.Flip(1<<32, 3<<32)
+	require.NoError(t, bm.Validate())
+	require.Equal(t, []uint64{1<<32 - 1, 3 << 32}, bm.ToArray())
+}
+
+func TestTreemap_Iterators(t *testing.T) {
+	values := []uint64{1, 2, math.MaxUint32, u64(7), u64(8), math.MaxUint64}
+	bm := New(values...)
+
+	var fwd []uint64
+	for it := bm.Iterator(); it.HasNext(); {
+		fwd = append(fwd, it.Next())
+	}
+	require.Equal(t, values, fwd)
+
+	var rev []uint64
+	for it := bm.ReverseIterator(); it.HasNext(); {
+		rev = append(rev, it.Next())
+	}
+	require.Equal(t, []uint64{math.MaxUint64, u64(8), u64(7), math.MaxUint32, 2, 1}, rev)
+
+	var many []uint64
+	buf := make([]uint64, 4)
+	for it, n := bm.ManyIterator(), 0; ; {
+		if n = it.NextMany(buf); n == 0 {
+			break
+		}
+		many = append(many, buf[:n]...)
+	}
+	require.Equal(t, values, many)
+
+	it := bm.Iterator()
+	it.AdvanceIfNeeded(3)
+	require.EqualValues(t, uint64(math.MaxUint32), it.PeekNext())
+	it.AdvanceIfNeeded(u64(3))
+	require.EqualValues(t, u64(7), it.Next())
+	it.AdvanceIfNeeded(u64(9))
+	require.EqualValues(t, uint64(math.MaxUint64), it.Next())
+	require.False(t, it.HasNext())
+}
+
+func TestTreemap_Pairs(t *testing.T) {
+	bm := New()
+	bm.AddPair(7, 1)
+	bm.AddPair(7, math.MaxUint32)
+	bm.AddPair(2, 5)
+	bm.AddPair(math.MaxUint32, 0)
+	require.True(t, bm.ContainsPair(7, math.MaxUint32))
+	require.True(t, bm.Contains(joinHiLo(2, 5)))
+	require.False(t, bm.ContainsPair(5, 2))
+	require.Equal(t, []uint32{2, 7, math.MaxUint32}, bm.Shards())
+	require.EqualValues(t, 2, bm.CardinalityOf(7))
+	require.EqualValues(t, 0, bm.CardinalityOf(8))
+
+	rows := bm.RowsOf(7)
+	require.Equal(t, []uint32{1, math.MaxUint32}, rows.ToArray())
+	rows.Add(3)
+	require.False(t, bm.ContainsPair(7, 3), "RowsOf returns a copy")
+	require.True(t, bm.RowsOf(8).IsEmpty())
+
+	require.True(t, bm.RemoveShard(7))
+	require.False(t, bm.RemoveShard(7))
+	require.Equal(t, []uint32{2, math.MaxUint32}, bm.Shards())
+	require.EqualValues(t, 2, bm.GetCardinality())
+
+	bm.RemovePair(2, 5)
+	require.Equal(t, []uint32{math.MaxUint32}, bm.Shards())
+	require.NoError(t, bm.Validate())
+}
+
+func TestTreemap_AddOffset(t *testing.T) {
+	bm := New(0, 5, math.MaxUint32, joinHiLo(1, 7), joinHiLo(3, math.MaxUint32-1), math.MaxUint64)
+	bm.AddRange(joinHiLo(2, 1<<16), joinHiLo(2, 1<<17))
+
+	shifted := bm.AddOffset(3 << 32)
+	require.Equal(t, []uint64{3 << 32, 3<<32 + 5, 4<<32 - 1, joinHiLo(4, 7)}, shifted.ToArray()[:4])
+	require.EqualValues(t, bm.GetCardinality()-1, shifted.GetCardinality())
+	require.False(t, shifted.Contains(math.MaxUint64))
+
+	shifted = bm.AddOffset(10)
+	require.Equal(t, []uint64{10, 15, 1<<32 + 9, joinHiLo(1, 17)}, shifted.ToArray()[:4])
+	require.True(t, shifted.Contains(joinHiLo(4, 8)))
+	require.True(t, shifted.Contains(joinHiLo(2, 1<<17+9)))
+	require.EqualValues(t, bm.GetCardinality()-1, shifted.GetCardinality())
+
+	shifted = bm.AddOffset(-6)
+	require.Equal(t, []uint64{math.MaxUint32 - 6, joinHiLo(1, 1)}, shifted.ToArray()[:2])
+	require.True(t, shifted.Contains(math.MaxUint64-6))
+	require.EqualValues(t, bm.GetCardinality()-2, shifted.GetCardinality())
+
+	shifted = bm.AddOffset(1 << 16)
+	require.True(t, shifted.Contains(joinHiLo(2, 1<<17)))
+	require.True(t, shifted.Contains(joinHiLo(4, 1<<16-2)))
+	require.NoError(t, shifted.Validate())
+
+	require.True(t, bm.AddOffset(0).Equals(bm))
+	require.True(t, bm.AddOffset(math.MinInt64).AddOffset(math.MaxInt64).AddOffset(1).Equals(New(math.MaxUint64)))
+	require.True(t, New().AddOffset(-1).IsEmpty())
+}
+
+func TestTreemap_Complement(t *testing.T) {
+	bm := New(5, joinHiLo(2, 7), math.MaxUint64)
+	bm.AddRange(joinHiLo(3, 0), joinHiLo(4, 0))
+
+	complement := bm.Complement(3, joinHiLo(4, 10))
+	require.NoError(t, complement.Validate())
+	require.EqualValues(t, 4<<32+10-3-2-1<<32, complement.GetCardinality())
+	require.False(t, complement.Contains(5))
+	require.True(t, complement.Contains(4))
+	require.False(t, complement.Contains(joinHiLo(2, 7)))
+	require.True(t, complement.Contains(joinHiLo(4, 9)))
+	require.False(t, complement.Contains(joinHiLo(4, 10)))
+	require.Equal(t, []uint32{0, 1, 2, 4}, complement.Shards())
+
+	stats := complement.Stats64(true)
+	require.EqualValues(t, 1<<16, stats.PerKey[1].RunContainers)
+	require.EqualValues(t, 1<<16, stats.PerKey[1].Containers)
+	require.EqualValues(t, 1, stats.PerKey[4].RunContainers)
+
+	require.True(t, bm.Complement(7, 7).IsEmpty())
+	require.True(t, bm.Complement(joinHiLo(3, 0), joinHiLo(4, 0)).IsEmpty())
+
+	complement.Not(3, joinHiLo(4, 10))
+	bm.Remove(math.MaxUint64)
+	require.True(t, bm.Equals(complement))
+	require.Equal(t, []uint32{0, 2, 3}, complement.Shards())
+
+	// a key that becomes full is rebuilt as runs
+	sparse := New(joinHiLo(1, 0), joinHiLo(1, 2), joinHiLo(1, 4))
+	sparse.Not(joinHiLo(1, 1), joinHiLo(1, 2))
+	sparse.Not(joinHiLo(1, 3), joinHiLo(1, 4))
+	sparse.Not(joinHiLo(1, 5), joinHiLo(2, 0))
+	require.EqualValues(t, 1<<32, sparse.GetCardinality())
+	stats = sparse.Stats64(true)
+	require.EqualValues(t, 1<<16, stats.PerKey[1].RunContainers)
+	require.NoError(t, sparse.Validate())
+}
+
+func TestTreemap_Compare(t *testing.T) {
+	a := New(1, 2, joinHiLo(3, 4))
+	require.True(t, a.IsSubsetOf(a))
+	require.False(t, a.IsStrictSubsetOf(a))
+	require.Zero(t, a.Compare(a.Clone()))
+	require.True(t, New().IsStrictSubsetOf(a))
+	require.True(t, New().IsDisjoint(a))
+	require.Equal(t, -1, New().Compare(a))
+
+	b := New(1, 2, joinHiLo(3, 4), joinHiLo(3, 5))
+	require.True(t, a.IsStrictSubsetOf(b))
+	require.False(t, b.IsSubsetOf(a))
+	require.False(t, a.IsDisjoint(b))
+	require.Equal(t, -1, a.Compare(b), "a prefix sorts first")
+	require.Equal(t, 1, b.Compare(a))
+
+	// {1, 2, 3<<32+4} against {1, 2, 5}: 5 comes before 3<<32+4
+	c := New(1, 2, 5)
+	require.Equal(t, 1, a.Compare(c))
+	require.Equal(t, -1, c.Compare(a))
+	require.False(t, c.IsSubsetOf(a))
+
+	// {1, 2} is a prefix of {1, 2, 5}
+	require.Equal(t, -1, New(1, 2).Compare(c))
+	require.Equal(t, 1, New(1, 3).Compare(c))
+	require.Equal(t, 1, New(joinHiLo(1, 0)).Compare(c))
+
+	require.True(t, New(joinHiLo(7, 1)).IsDisjoint(New(joinHiLo(7, 2), joinHiLo(8, 1))))
+	require.False(t, New(joinHiLo(8, 1)).IsDisjoint(New(joinHiLo(7, 2), joinHiLo(8, 1))))
+	require.True(t, New(joinHiLo(8, 1)).IsStrictSubsetOf(New(joinHiLo(7, 2), joinHiLo(8, 1))))
+	require.False(t, New(joinHiLo(9, 1)).IsSubsetOf(New(joinHiLo(7, 2), joinHiLo(8, 1))))
+}
+
+func TestTreemap_Hash(t *testing.T) {
+	require.Zero(t, New().Hash64())
+	require.Equal(t, [2]uint64{}, New().Hash128())
+
+	// the same values as arrays, bitmaps and runs
+	values := New()
+	for v := uint64(0); v < 10000; v++ {
+		values.Add(v)
+	}
+	values.Add(joinHiLo(5, 1))
+	values.Add(math.MaxUint64)
+
+	ranges := New(joinHiLo(5, 1), math.MaxUint64)
+	ranges.AddRange(0, 10000)
+
+	flipped := New(3, joinHiLo(5, 1), math.MaxUint64)
+	flipped.Flip(0, 20000)
+	flipped.Flip(10000, 20000)
+	flipped.Add(3)
+
+	optimized := values.Clone()
+	optimized.RunOptimize()
+
+	jvm, err := values.Clone().WithJvmSerializer().ToBytes()
+	require.NoError(t, err)
+	read := New().WithJvmSerializer()
+	require.NoError(t, read.UnmarshalBinary(jvm))
+
+	for _, other := range []*BTreemap{ranges, flipped, optimized, read} {
+		require.True(t, values.Equals(other))
+		require.Equal(t, values.Hash64(), other.Hash64())
+		require.Equal(t, values.Hash128(), other.Hash128())
+	}
+
+	different := values.Clone()
+	different.Remove(5000)
+	require.NotEqual(t, values.Hash64(), different.Hash64())
+	require.NotEqual(t, values.Hash128(), different.Hash128())
+	require.NotEqual(t, New(1).Hash64(), New(joinHiLo(1, 0)).Hash64())
+
+	// the hash is the sum of the key hashes
+	require.Equal(t, values.KeyHash64(0)+values.KeyHash64(5)+values.KeyHash64(math.MaxUint32), values.Hash64())
+	require.Zero(t, values.KeyHash64(4))
+	before, key := different.Hash64(), different.KeyHash64(0)
+	different.Add(5000)
+	require.Equal(t, values.Hash64(), before-key+different.KeyHash64(0))
+}
+
+func TestTreemap_Threshold(t *testing.T) {
+	a := New(1, 2, 3, joinHiLo(1, 1), math.MaxUint64)
+	b := New(2, 3, 4, joinHiLo(1, 1))
+	c := New(3, 4, 5, joinHiLo(2, 1), math.MaxUint64)
+	c.AddRange(joinHiLo(3, 0), joinHiLo(3, 100000))
+
+	require.Equal(t, []uint64{1, 2, 3, 4, 5, joinHiLo(1, 1), joinHiLo(2, 1)}, Threshold(1, a, b, c).ToArray()[:7])
+	require.True(t, Threshold(0, a, b, c).Equals(FastOr(a, b, c)))
+	require.Equal(t, []uint64{2, 3, 4, joinHiLo(1, 1), math.MaxUint64}, Threshold(2, a, b, c).ToArray())
+	require.Equal(t, []uint64{3}, Threshold(3, a, b, c).ToArray())
+	require.True(t, Threshold(4, a, b, c).IsEmpty())
+	require.True(t, Threshold(1).IsEmpty())
+
+	// the inputs are left alone
+	require.Equal(t, uint64(5), a.GetCardinality())
+
+	occ := CountOccurrences(a, b, c, a)
+	require.Equal(t, 4, occ.Count(3))
+	require.Equal(t, 3, occ.Count(2))
+	require.Equal(t, 3, occ.Count(math.MaxUint64))
+	require.Equal(t, 1, occ.Count(joinHiLo(3, 99999)))
+	require.Zero(t, occ.Count(6))
+	require.Zero(t, occ.Count(joinHiLo(4, 0)))
+
+	require.Equal(t, []uint64{2, joinHiLo(1, 1), math.MaxUint64}, occ.Exactly(3).ToArray())
+	require.Equal(t, []uint64{2, 3, joinHiLo(1, 1), math.MaxUint64}, occ.AtLeast(3).ToArray())
+	require.True(t, occ.AtLeast(5).IsEmpty())
+	require.True(t, occ.AtLeast(2).Equals(Threshold(2, a, b, c, a)))
+
+	// count 4 = 0b100 lives in the third slice only
+	slices := occ.BitSlices()
+	require.Len(t, slices, 3)
+	require.Equal(t, []uint64{3}, slices[2].ToArray())
+	require.False(t, slices[0].Contains(3))
+
+	var values []uint64
+	var counts []int
+	occ.Iterate(func(v uint64, count int) bool {
+		values = append(values, v)
+		counts = append(counts, count)
+		return len(values) < 5
+	})
+	require.Equal(t, []uint64{1, 2, 3, 4, 5}, values)
+	require.Equal(t, []int{2, 3, 4, 2, 1}, counts)
+}
+
+func TestTreemap_Page(t *testing.T) {
+	bm := New(1, 2, 3, joinHiLo(1, 5), math.MaxUint64)
+	bm.AddRange(joinHiLo(2, 0), joinHiLo(2, 100000))
+
+	require.Equal(t, []uint64{1, 2}, bm.Page(0, 2))
+	require.Equal(t, []uint64{3, joinHiLo(1, 5), joinHiLo(2, 0)}, bm.Page(2, 3))
+	require.Equal(t, []uint64{joinHiLo(2, 50000), joinHiLo(2, 50001)}, bm.Page(50004, 2))
+	require.Equal(t, []uint64{joinHiLo(2, 99999), math.MaxUint64}, bm.Page(100003, math.MaxUint64))
+	require.Empty(t, bm.Page(100005, 10))
+	require.Empty(t, bm.Page(1, 0))
+	require.Len(t, bm.Page(0, math.MaxUint64), 100005)
+
+	require.Equal(t, []uint64{joinHiLo(1, 5), joinHiLo(2, 0)}, bm.SelectRange(3, 5))
+	require.Empty(t, bm.SelectRange(5, 3))
+	for _, rank := range []uint64{0, 3, 4, 1000, 100004} {
+		v, err := bm.Select(rank)
+		require.NoError(t, err)
+		require.Equal(t, []uint64{v}, bm.SelectRange(rank, rank+1))
+	}
+}
+
+func TestTreemap_CardinalityIndex(t *testing.T) {
+	bm := New().WithCardinalityIndex()
+	require.Zero(t, bm.GetCardinality())
+	require.Zero(t, bm.Rank(10))
+	_, err := bm.Select(0)
+	require.Error(t, err)
+
+	bm.AddMany([]uint64{1, 2, joinHiLo(3, 7), math.MaxUint64})
+	bm.AddRange(joinHiLo(2, 0), joinHiLo(2, 1000))
+	require.Equal(t, uint64(1004), bm.GetCardinality())
+	require.Equal(t, uint64(2), bm.Rank(joinHiLo(1, 0)))
+	require.Equal(t, uint64(503), bm.Rank(joinHiLo(2, 500)))
+	require.Equal(t, uint64(1003), bm.Rank(joinHiLo(3, 8)))
+	require.Equal(t, uint64(1004), bm.Rank(math.MaxUint64))
+	v, err := bm.Select(1002)
+	require.NoError(t, err)
+	require.Equal(t, joinHiLo(3, 7), v)
+	require.Equal(t, []uint64{joinHiLo(2, 999), joinHiLo(3, 7)}, bm.SelectRange(1001, 1003))
+
+	// every kind of mutation drops the index
+	bm.Remove(1)
+	require.Equal(t, uint64(1003), bm.GetCardinality())
+	bm.RemoveRange(joinHiLo(2, 0), joinHiLo(2, 500))
+	require.Equal(t, uint64(503), bm.GetCardinality())
+	bm.Flip(0, 2)
+	require.Equal(t, uint64(505), bm.GetCardinality())
+	bm.Or(New(5, 6))
+	require.Equal(t, uint64(507), bm.GetCardinality())
+	bm.AndNot(New(5))
+	require.Equal(t, uint64(506), bm.GetCardinality())
+	bm.AddPair(9, 9)
+	require.Equal(t, uint64(507), bm.GetCardinality())
+	require.True(t, bm.RemoveShard(9))
+	require.Equal(t, uint64(506), bm.GetCardinality())
+
+	data, err := New(1, 2, 3).ToBytes()
+	require.NoError(t, err)
+	require.NoError(t, bm.UnmarshalBinary(data))
+	require.Equal(t, uint64(3), bm.GetCardinality())
+
+	cloned := bm.Clone()
+	cloned.Add(4)
+	require.Equal(t, uint64(4), cloned.GetCardinality())
+	require.Equal(t, uint64(3), bm.GetCardinality())
+	bm.Clear()
+	require.Zero(t, bm.GetCardinality())
+}
+
+// manyKeys spreads a few values over every one of n high keys
+func manyKeys(n uint32) *BTreemap {
+	bm := New()
+	for hi := uint32(0); hi < n; hi++ {
+		bm.AddRange(joinHiLo(hi, 0), joinHiLo(hi, 16))
+	}
+	return bm
+}
+
+func benchmarkCardinality(b *testing.B, query func(bm *BTreemap, i int)) {
+	for _, indexed := range []bool{false, true} {
+		name := "scan"
+		bm := manyKeys(100000)
+		if indexed {
+			name = "index"
+			bm.WithCardinalityIndex()
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				query(bm, i)
+			}
+		})
+	}
+}
+
+func BenchmarkTreemap_GetCardinality(b *testing.B) {
+	benchmarkCardinality(b, func(bm *BTreemap, i int) {
+		bm.GetCardinality()
+	})
+}
+
+func BenchmarkTreemap_Rank(b *testing.B) {
+	benchmarkCardinality(b, func(bm *BTreemap, i int) {
+		bm.Rank(joinHiLo(uint32(i%100000), 8))
+	})
+}
+
+func BenchmarkTreemap_Select(b *testing.B) {
+	benchmarkCardinality(b, func(bm *BTreemap, i int) {
+		_, _ = bm.Select(uint64(i) % (16 * 100000))
+	})
+}
+
+func BenchmarkTreemap_Page(b *testing.B) {
+	benchmarkCardinality(b, func(bm *BTreemap, i int) {
+		bm.Page(uint64(i)%(16*100000), 100)
+	})
+}
+
+func TestTreemap_Sample(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	_, err := New().RandomValue(rng)
+	require.Error(t, err)
+	require.Empty(t, New().Sample(3, rng))
+	require.False(t, New().PermutedIterator(1).HasNext())
+
+	bm := New(joinHiLo(1, 1), math.MaxUint64)
+	bm.AddRange(0, 1000)
+	bm.AddRange(joinHiLo(7, 0), joinHiLo(7, 1000))
+
+	// every value is drawn, roughly as often as the others
+	seen := map[uint64]int{}
+	for i := 0; i < 40000; i++ {
+		v, err := bm.RandomValue(rng)
+		require.NoError(t, err)
+		require.True(t, bm.Contains(v))
+		seen[v]++
+	}
+	require.Len(t, seen, 2002)
+	require.InDelta(t, 20, seen[math.MaxUint64], 15)
+	require.InDelta(t, 20, seen[joinHiLo(1, 1)], 15)
+
+	sample := bm.Sample(100, rng)
+	require.Len(t, sample, 100)
+	require.True(t, sort.SliceIsSorted(sample, func(i, j int) bool { return sample[i] < sample[j] }))
+	require.True(t, New(sample...).IsSubsetOf(bm))
+	require.Equal(t, bm.ToArray(), bm.Sample(5000, rng))
+
+	// the same seed gives the same order
+	first, second := bm.PermutedIterator(42), bm.PermutedIterator(42)
+	var permuted []uint64
+	for first.HasNext() {
+		v := first.Next()
+		require.Equal(t, v, second.Next())
+		permuted = append(permuted, v)
+	}
+	require.False(t, second.HasNext())
+	require.NotEqual(t, bm.ToArray(), permuted)
+	require.True(t, New(permuted...).Equals(bm))
+	require.Len(t, permuted, 2002)
+
+	other, reseeded := bm.PermutedIterator(43), make([]uint64, 10)
+	for i := range reseeded {
+		reseeded[i] = other.Next()
+	}
+	require.NotEqual(t, permuted[:10], reseeded)
+}
+
+func TestTreemap_Split(t *testing.T) {
+	build := func() *BTreemap {
+		bm := New(1, joinHiLo(1, 5), joinHiLo(2, 1), math.MaxUint64)
+		bm.AddRange(joinHiLo(1, 0x10000), joinHiLo(1, 0x40000))
+		return bm
+	}
+
+	bm := build()
+	lower, upper := bm.SplitAt(joinHiLo(1, 0x20000))
+	require.True(t, bm.IsEmpty())
+	require.Equal(t, uint64(2+0x10000), lower.GetCardinality())
+	require.Equal(t, uint64(0x20000+2), upper.GetCardinality())
+	require.Equal(t, joinHiLo(1, 0x1FFFF), lower.Maximum())
+	require.Equal(t, joinHiLo(1, 0x20000), upper.Minimum())
+	// the halves of the cut key don't share containers that change
+	lower.Add(joinHiLo(1, 0x30000))
+	upper.Remove(joinHiLo(1, 0x1FFFF))
+	require.True(t, upper.Contains(joinHiLo(1, 0x30000)))
+	require.True(t, lower.Contains(joinHiLo(1, 0x1FFFF)))
+	require.NoError(t, lower.Validate())
+	require.NoError(t, upper.Validate())
+
+	lower, upper = build().SplitAt(joinHiLo(2, 0))
+	require.Equal(t, []uint64{joinHiLo(2, 1), math.MaxUint64}, upper.ToArray())
+	lower, upper = build().SplitAt(0)
+	require.True(t, lower.IsEmpty())
+	require.True(t, upper.Equals(build()))
+
+	parts := build().PartitionByCardinality(3)
+	require.Len(t, parts, 3)
+	var merged []uint64
+	for _, part := range parts {
+		require.InDelta(t, (0x30000+4)/3, part.GetCardinality(), 1)
+		merged = append(merged, part.ToArray()...)
+	}
+	require.Equal(t, build().ToArray(), merged)
+	require.Nil(t, build().PartitionByCardinality(0))
+	require.Len(t, New(1).PartitionByCardinality(4), 4)
+
+	byKey := build().PartitionByHighBits(func(hi uint32) int {
+		if hi == math.MaxUint32 {
+			return -1
+		}
+		return int(hi)
+	})
+	require.Len(t, byKey, 3)
+	require.Equal(t, []uint64{1}, byKey[0].ToArray())
+	require.Equal(t, []uint64{joinHiLo(2, 1)}, byKey[2].ToArray())
+	require.Equal(t, uint64(0x30001), byKey[1].GetCardinality())
+}
+
+func TestTreemap_Append(t *testing.T) {
+	day1 := New(1, 2, joinHiLo(1, 5))
+	day2 := New(joinHiLo(1, 6), joinHiLo(2, 0))
+	day2.AddRange(joinHiLo(3, 0), joinHiLo(3, 100000))
+	moved := day2.RowsOf(3)
+
+	require.True(t, errors.Is(day2.Append(day1), ErrOverlap))
+	require.Equal(t, uint64(100002), day2.GetCardinality())
+
+	require.NoError(t, day1.Append(day2))
+	require.True(t, day2.IsEmpty())
+	require.Equal(t, uint64(100005), day1.GetCardinality())
+	require.Equal(t, []uint64{1, 2, joinHiLo(1, 5), joinHiLo(1, 6), joinHiLo(2, 0)}, day1.Page(0, 5))
+	require.True(t, moved.Equals(day1.RowsOf(3)))
+	require.NoError(t, day1.Append(New()))
+	require.True(t, errors.Is(day1.Append(New(joinHiLo(3, 99999))), ErrOverlap))
+
+	empty := New()
+	require.NoError(t, empty.Append(New(7)))
+	require.Equal(t, []uint64{7}, empty.ToArray())
+
+	a, b, c := New(1, joinHiLo(5, 1)), New(2, joinHiLo(6, 1)), New(joinHiLo(5, 2))
+	merged, err := MergeDisjoint(a, b, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2, joinHiLo(5, 1), joinHiLo(5, 2), joinHiLo(6, 1)}, merged.ToArray())
+	require.True(t, a.IsEmpty() && b.IsEmpty() && c.IsEmpty())
+
+	a, b = New(1, joinHiLo(5, 1)), New(2, joinHiLo(5, 1))
+	_, err = MergeDisjoint(a, b)
+	require.True(t, errors.Is(err, ErrOverlap))
+	require.Equal(t, []uint64{1, joinHiLo(5, 1)}, a.ToArray())
+	require.Equal(t, []uint64{2, joinHiLo(5, 1)}, b.ToArray())
+
+	// daily segments below 2^32 all share high key 0
+	segments := make([]*BTreemap, 10000)
+	for i := range segments {
+		segments[i] = New(uint64(i)*10, uint64(i)*10+1)
+	}
+	segments[len(segments)-1].Add(1)
+	_, err = MergeDisjoint(segments...)
+	require.True(t, errors.Is(err, ErrOverlap))
+	require.Equal(t, []uint64{0, 1}, segments[0].ToArray())
+	require.Equal(t, uint64(3), segments[len(segments)-1].GetCardinality())
+
+	segments[len(segments)-1].Remove(1)
+	merged, err = MergeDisjoint(segments...)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*len(segments)), merged.GetCardinality())
+	require.True(t, segments[0].IsEmpty())
+}
+
+func TestTreemap_SizeLimit(t *testing.T) {
+	bm := New().WithSizeLimit(70)
+	for v := uint64(0); v < 20; v++ {
+		require.NoError(t, bm.TryAdd(v))
+	}
+	require.NoError(t, bm.TryAdd(5))
+
+	// a new key costs more than the budget has left
+	err := bm.TryAdd(joinHiLo(1, 0))
+	require.True(t, errors.Is(err, ErrSizeLimit))
+	require.False(t, bm.Contains(joinHiLo(1, 0)))
+	require.Equal(t, uint64(20), bm.GetCardinality())
+
+	// a large range only fits as a run container, which TryAddRange gets to by run optimizing
+	require.NoError(t, bm.TryAddRange(1000, 50000))
+	require.Equal(t, uint64(49020), bm.GetCardinality())
+	require.LessOrEqual(t, bm.GetSizeInBytes(), uint64(70))
+
+	sparse := New()
+	for v := uint64(0); v < 1000; v++ {
+		sparse.Add(joinHiLo(2, uint32(v*7)))
+	}
+	require.True(t, errors.Is(bm.TryOr(sparse), ErrSizeLimit))
+	require.Equal(t, uint64(49020), bm.GetCardinality())
+
+	// mutations outside the Try variants are measured again by the next Try
+	bm.Or(sparse)
+	require.True(t, errors.Is(bm.TryAdd(3000000), ErrSizeLimit))
+	bm.WithSizeLimit(0)
+	require.NoError(t, bm.TryAdd(3000000))
+	require.True(t, bm.Contains(3000000))
+}
+
+func TestTreemap_Compact(t *testing.T) {
+	bm := New(1, joinHiLo(2, 1))
+	for v := uint64(0); v < 4000; v++ {
+		bm.Add(joinHiLo(3, uint32(v)))
+	}
+	bm.RemoveRange(joinHiLo(3, 0), joinHiLo(3, 3990))
+	bm.getOrInsert(4)
+	bm.getOrInsert(5)
+	require.False(t, bm.Equals(New(1, joinHiLo(2, 1))))
+
+	before := bm.Clone()
+	bm.Compact(false)
+	require.Equal(t, 3, bm.tree.Len())
+	require.Equal(t, before.ToArray(), bm.ToArray())
+	// the clone kept the empty keys
+	require.False(t, bm.Equals(before))
+	before.Compact(false)
+	require.True(t, bm.Equals(before))
+
+	bm.RemoveRange(joinHiLo(3, 0), joinHiLo(4, 0))
+	bm.Compact(true)
+	require.True(t, bm.Equals(New(1, joinHiLo(2, 1))))
+
+	ranges := New()
+	for v := uint64(0); v < 5000; v++ {
+		ranges.Add(v)
+	}
+	ranges.Compact(true)
+	require.Equal(t, uint64(1), ranges.Stats().RunContainers)
+	require.Equal(t, uint64(5000), ranges.GetCardinality())
+
+	ranges.Clear()
+	require.Zero(t, ranges.tree.Len())
+}
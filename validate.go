@@ -0,0 +1,182 @@
+package roaring64
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Validate checks the invariants every operation keeps: high keys are unique and increasing,
+// and each of them holds a non-empty, well formed bitmap.
+func (tm *BTreemap) Validate() error {
+	var err error
+	var prev uint32
+	first := true
+	tm.forEachBitmap(func(bm *keyedBitmap) bool {
+		switch {
+		case !first && bm.HighBits <= prev:
+			err = fmt.Errorf("high key %d follows %d", bm.HighBits, prev)
+		case bm.Bitmap == nil:
+			err = fmt.Errorf("high key %d has no bitmap", bm.HighBits)
+		case bm.IsEmpty():
+			err = fmt.Errorf("high key %d has an empty bitmap", bm.HighBits)
+		default:
+			if e := checkContainers(bm.Bitmap); e != nil {
+				err = fmt.Errorf("high key %d: %v", bm.HighBits, e)
+			}
+		}
+		first, prev = false, bm.HighBits
+		return err == nil
+	})
+	return err
+}
+
+const (
+	// containers with more values than this are stored as bitmaps when they aren't runs
+	arrayContainerMax = 4096
+	// below this many containers a bitmap with runs has no offset header
+	noOffsetThreshold = 4
+)
+
+var errTruncatedBitmap = errors.New("truncated")
+
+// checkContainers checks the containers of a bitmap in memory through its portable serialization,
+// which is cheaper than walking the values of large runs. It can't see cardinalities claimed by the input
+// the bitmap was read from, decodeTree checks those on the bytes it reads.
+func checkContainers(bm *roaring.Bitmap) error {
+	data, err := bm.ToBytes()
+	if err != nil {
+		return err
+	}
+	return checkPortable(data)
+}
+
+// checkPortable validates a 32-bit bitmap in the RoaringFormatSpec layout,
+// including the cardinality in the header of run containers which the roaring reader discards
+func checkPortable(data []byte) error {
+	next := func(n int) ([]byte, error) {
+		if len(data) < n {
+			return nil, errTruncatedBitmap
+		}
+		b := data[:n]
+		data = data[n:]
+		return b, nil
+	}
+
+	head, err := next(4)
+	if err != nil {
+		return err
+	}
+	cookie := binary.LittleEndian.Uint32(head)
+	var size int
+	var runFlags []byte
+	switch {
+	case cookie&0xFFFF == serialCookie:
+		size = int(cookie>>16) + 1
+		if runFlags, err = next((size + 7) / 8); err != nil {
+			return err
+		}
+	case cookie == serialCookieNoRunContainer:
+		if head, err = next(4); err != nil {
+			return err
+		}
+		size = int(binary.LittleEndian.Uint32(head))
+		if size > 1<<16 {
+			return fmt.Errorf("%d containers", size)
+		}
+	default:
+		return fmt.Errorf("unknown cookie %d", cookie)
+	}
+
+	header, err := next(4 * size)
+	if err != nil {
+		return err
+	}
+	if runFlags == nil || size >= noOffsetThreshold {
+		if _, err := next(4 * size); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < size; i++ {
+		key := binary.LittleEndian.Uint16(header[4*i:])
+		card := int(binary.LittleEndian.Uint16(header[4*i+2:])) + 1
+		if i > 0 && key <= binary.LittleEndian.Uint16(header[4*i-4:]) {
+			return fmt.Errorf("container key %d follows %d", key, binary.LittleEndian.Uint16(header[4*i-4:]))
+		}
+
+		var err error
+		switch {
+		case runFlags != nil && runFlags[i/8]&(1<<(uint(i)%8)) != 0:
+			err = checkRunContainer(next, card)
+		case card <= arrayContainerMax:
+			err = checkArrayContainer(next, card)
+		default:
+			err = checkBitmapContainer(next, card)
+		}
+		if err != nil {
+			return fmt.Errorf("container %d: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func checkRunContainer(next func(int) ([]byte, error), card int) error {
+	head, err := next(2)
+	if err != nil {
+		return err
+	}
+	runs, err := next(4 * int(binary.LittleEndian.Uint16(head)))
+	if err != nil {
+		return err
+	}
+	total := 0
+	prevEnd := -1
+	for j := 0; j < len(runs); j += 4 {
+		start := int(binary.LittleEndian.Uint16(runs[j:]))
+		end := start + int(binary.LittleEndian.Uint16(runs[j+2:]))
+		if start <= prevEnd {
+			return fmt.Errorf("run starting at %d overlaps the previous one", start)
+		}
+		if end > 0xFFFF {
+			return fmt.Errorf("run starting at %d overflows the container", start)
+		}
+		total += end - start + 1
+		prevEnd = end
+	}
+	if total != card {
+		return fmt.Errorf("cardinality is %d but the runs hold %d values", card, total)
+	}
+	return nil
+}
+
+func checkArrayContainer(next func(int) ([]byte, error), card int) error {
+	values, err := next(2 * card)
+	if err != nil {
+		return err
+	}
+	for j := 2; j < len(values); j += 2 {
+		if binary.LittleEndian.Uint16(values[j:]) <= binary.LittleEndian.Uint16(values[j-2:]) {
+			return fmt.Errorf("array values aren't sorted")
+		}
+	}
+	return nil
+}
+
+func checkBitmapContainer(next func(int) ([]byte, error), card int) error {
+	words, err := next(8192)
+	if err != nil {
+		return err
+	}
+	total := 0
+	for j := 0; j < len(words); j += 8 {
+		total += bits.OnesCount64(binary.LittleEndian.Uint64(words[j:]))
+	}
+	if total != card {
+		return fmt.Errorf("cardinality is %d but the bitmap holds %d values", card, total)
+	}
+	return nil
+}